@@ -2,14 +2,26 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
+	"strings"
 
 	_ "embed"
 
 	"github.com/cpuguy83/qemu-micro-env/build"
 	"github.com/docker/go-units"
 	"github.com/moby/buildkit/client/llb"
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	rootModeReadWrite = "rw"
+	rootModeReadOnly  = "ro"
 )
 
 const (
@@ -25,68 +37,253 @@ func mkImage(ctx context.Context, spec *build.DiskImageSpec) (llb.State, error)
 		return llb.Scratch(), fmt.Errorf("error generating entrypoint module LLB: %w", err)
 	}
 
+	kernelDisk := spec.KernelDisk()
+
 	if build.UseMergeOp {
+		rootfs := spec.Build()
 		states := []llb.State{
 			build.QemuBase(),
 			entrypoint,
-			spec.Build().State(),
+			rootfs.State(),
+			build.QcowInfo(rootfs).State(),
+			build.Passt().State(),
 			spec.Kernel.Kernel.State(),
 			spec.Kernel.Initrd.State(),
 		}
+		if !kernelDisk.IsEmpty() {
+			states = append(states, kernelDisk.State())
+		}
+		if !spec.Disk.ReadOnly {
+			states = append(states, build.QcowDiff(rootfs).State())
+		}
 		return llb.Merge(states), nil
 	}
 
 	specFile := spec.Build()
 	st := build.QemuBase().File(llb.Copy(entrypoint, entrypointPath, entrypointPath))
 	st = specFile.CopyTo(st)
+	st = build.QcowInfo(specFile).CopyTo(st)
+	st = build.Passt().CopyTo(st)
 	st = spec.Kernel.Kernel.CopyTo(st)
 	st = spec.Kernel.Initrd.CopyTo(st)
+	if !kernelDisk.IsEmpty() {
+		st = kernelDisk.CopyTo(st)
+	}
+	if !spec.Disk.ReadOnly {
+		st = build.QcowDiff(specFile).CopyTo(st)
+	}
 
 	return st, nil
 }
 
-func specFromFlags(ctx context.Context, cfg vmImageConfig) (*build.DiskImageSpec, error) {
+func specFromFlags(ctx context.Context, client gateway.Client, cfg vmImageConfig) (*build.DiskImageSpec, error) {
 	var (
 		spec build.DiskImageSpec
 	)
 
-	if cfg.rootfs != "" {
-		spec.Rootfs = llb.Image(cfg.rootfs)
+	base, err := getRootfs(ctx, client, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.rootfs.scheme == "docker-image" {
+		spec.Rootfs = base
 	} else {
 		initMod, err := InitModule()
 		if err != nil {
 			return nil, err
 		}
 
-		mobySt, err := build.GetMoby("")
+		workload, err := build.GetWorkload(cfg.preset)
 		if err != nil {
 			return nil, err
 		}
-		if build.UseMergeOp {
-			spec.Rootfs = llb.Merge([]llb.State{build.JammyRootfs(), initMod, mobySt, build.DockerdInitScript().State()})
-		} else {
-			script := build.DockerdInitScript()
-			spec.Rootfs = build.JammyRootfs().
-				File(llb.Copy(initMod, initPath, initPath)).
-				File(llb.Copy(mobySt, "/", "/")).
-				File(llb.Copy(build.DockerdInitScript().State(), script.Path(), script.Path()))
+		spec.Rootfs, err = addWorkload(base, initMod, workload, cfg)
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	var err error
-	spec.Kernel, err = getKernel(cfg)
+	spec.Rootfs, err = customizeRootfs(spec.Rootfs, cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	spec.Size, err = units.FromHumanSize(cfg.size)
+	spec.Kernel, err = getKernel(ctx, client, cfg)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing qcow size: %w", err)
+		return nil, err
+	}
+
+	spec.Disk, err = diskConfig(cfg)
+	if err != nil {
+		return nil, err
 	}
 
 	return &spec, nil
 }
 
+// addWorkload layers init and everything needed to run the workload on top of the base rootfs.
+func addWorkload(base, initMod llb.State, w build.Workload, cfg vmImageConfig) (llb.State, error) {
+	if len(w.Packages) > 0 {
+		distro, err := build.GetDistro(cfg.distro)
+		if err != nil {
+			return base, err
+		}
+		base = distro.Install(base, w.Packages...)
+	}
+
+	var bins []llb.State
+	if len(w.MobyBinaries) > 0 {
+		mobySt, err := build.GetMoby(cfg.moby.String(),
+			build.WithMobyStaticURL(cfg.mobyURL),
+			build.WithMobyLocal(llb.Local(mobyContext)),
+			build.WithMobyBinaries(w.MobyBinaries...),
+		)
+		if err != nil {
+			return base, err
+		}
+		bins = append(bins, mobySt)
+	}
+	if w.Binaries != nil {
+		bins = append(bins, w.Binaries())
+	}
+
+	script := w.InitScript()
+	if build.UseMergeOp {
+		states := append([]llb.State{base, initMod}, bins...)
+		return llb.Merge(append(states, script.State())), nil
+	}
+
+	st := base.File(llb.Copy(initMod, initPath, initPath))
+	for _, b := range bins {
+		st = st.File(llb.Copy(b, "/", "/"))
+	}
+	return st.File(llb.Copy(script.State(), script.Path(), script.Path())), nil
+}
+
+// getRootfs returns the base rootfs to use for the VM.
+// Images referenced with docker-image:// are used as is, everything else gets the init and dockerd bits layered on top.
+func getRootfs(ctx context.Context, client gateway.Client, cfg vmImageConfig) (llb.State, error) {
+	switch cfg.rootfs.scheme {
+	case "":
+		distro, err := build.GetDistro(cfg.distro)
+		if err != nil {
+			return llb.Scratch(), err
+		}
+		return distro.Rootfs(), nil
+	case "docker-image":
+		return llb.Image(cfg.rootfs.ref), nil
+	case "dockerfile":
+		p, target := cfg.rootfs.dockerfile()
+		res, err := client.Solve(ctx, gateway.SolveRequest{
+			Frontend: "dockerfile.v0",
+			FrontendOpt: map[string]string{
+				"filename":      filepath.Base(p),
+				"target":        target,
+				"contextkey":    rootfsContext,
+				"dockerfilekey": rootfsDockerfileContext,
+			},
+		})
+		if err != nil {
+			return llb.Scratch(), fmt.Errorf("error building rootfs dockerfile: %w", err)
+		}
+		ref, err := res.SingleRef()
+		if err != nil {
+			return llb.Scratch(), err
+		}
+		return ref.ToState()
+	case "local":
+		return llb.Local(rootfsContext), nil
+	case "tar":
+		base := filepath.Base(cfg.rootfs.ref)
+		src := llb.Local(rootfsContext, llb.FollowPaths([]string{base}), llb.IncludePatterns([]string{base}))
+		return llb.Image(build.JammyRef).Run(
+			llb.AddMount("/tmp/rootfs.tar", src, llb.Readonly, llb.SourcePath(base)),
+			llb.Args([]string{"tar", "-C", "/tmp/rootfs", "-xf", "/tmp/rootfs.tar"}),
+		).AddMount("/tmp/rootfs", llb.Scratch()), nil
+	default:
+		return llb.Scratch(), fmt.Errorf("unsupported scheme for rootfs: %s", cfg.rootfs.scheme)
+	}
+}
+
+// diskConfig parses the root disk flags.
+// The size is either a fixed size or "auto[+headroom]" to size the disk based on the rootfs content.
+func diskConfig(cfg vmImageConfig) (build.DiskConfig, error) {
+	disk := build.DiskConfig{Filesystem: cfg.fs}
+	switch cfg.rootMode {
+	case rootModeReadWrite:
+	case rootModeReadOnly:
+		disk.ReadOnly = true
+	default:
+		return disk, fmt.Errorf("invalid root mode %q, must be %s or %s", cfg.rootMode, rootModeReadWrite, rootModeReadOnly)
+	}
+	if err := disk.Validate(); err != nil {
+		return disk, err
+	}
+
+	if headroom, ok := strings.CutPrefix(cfg.size, "auto"); ok {
+		if headroom == "" {
+			return disk, nil
+		}
+		if !strings.HasPrefix(headroom, "+") {
+			return disk, fmt.Errorf("invalid qcow size %q, must be auto[+headroom]", cfg.size)
+		}
+		var err error
+		disk.Headroom, err = units.FromHumanSize(headroom[1:])
+		if err != nil {
+			return disk, fmt.Errorf("error parsing qcow size headroom: %w", err)
+		}
+		return disk, nil
+	}
+
+	var err error
+	disk.Size, err = units.FromHumanSize(cfg.size)
+	if err != nil {
+		return disk, fmt.Errorf("error parsing qcow size: %w", err)
+	}
+	return disk, nil
+}
+
+// customizeRootfs applies the user requested packages, files, and commands to the rootfs.
+func customizeRootfs(st llb.State, cfg vmImageConfig) (llb.State, error) {
+	if len(cfg.packages) > 0 {
+		distro, err := build.GetDistro(cfg.distro)
+		if err != nil {
+			return st, err
+		}
+		st = distro.Install(st, cfg.packages...)
+	}
+
+	for i, c := range cfg.copyIns {
+		st = copyInto(st, c, c.contextName(i))
+	}
+
+	for _, cmd := range cfg.runs {
+		st = st.Run(llb.Args([]string{"/bin/sh", "-c", cmd})).Root()
+	}
+	return st, nil
+}
+
+// copyInto copies a file or directory from the named local build context into the state.
+// Directories have their content copied into the destination.
+func copyInto(st llb.State, c copyIn, name string) llb.State {
+	if c.isDir {
+		return st.File(llb.Copy(llb.Local(name), "/", c.dest, &llb.CopyInfo{
+			Mode:                c.mode,
+			CreateDestPath:      true,
+			CopyDirContentsOnly: true,
+		}))
+	}
+
+	base := filepath.Base(c.src)
+	src := llb.Local(name, llb.FollowPaths([]string{base}), llb.IncludePatterns([]string{base}))
+	return st.File(llb.Copy(src, base, c.dest, &llb.CopyInfo{
+		Mode:           c.mode,
+		CreateDestPath: true,
+		FollowSymlinks: true,
+	}))
+}
+
 var defaultKernelSt = build.JammyRootfs().Run(
 	llb.AddEnv("DEBIAN_FRONTEND", "noninteractive"),
 	llb.Args([]string{
@@ -94,7 +291,7 @@ var defaultKernelSt = build.JammyRootfs().Run(
 	}),
 ).Root()
 
-func getKernel(cfg vmImageConfig) (build.Kernel, error) {
+func getKernel(ctx context.Context, client gateway.Client, cfg vmImageConfig) (build.Kernel, error) {
 	var k build.Kernel
 
 	if cfg.kernel.isEmpty() {
@@ -104,13 +301,17 @@ func getKernel(cfg vmImageConfig) (build.Kernel, error) {
 	} else {
 		switch cfg.kernel.scheme {
 		case "version":
-			src, err := build.GetKernelSource(cfg.kernel.ref)
+			rel, err := resolveKernelRelease(ctx, client, cfg)
 			if err != nil {
 				return k, fmt.Errorf("error getting kernel source: %w", err)
 			}
+			src := build.GetKernelSourceFromRelease(rel)
 			k.Config, k.Kernel, k.Modules = build.BuildKernel(build.KernelBuildBase(), src, nil)
 		case "docker-image":
-			k.Kernel = build.NewFile(llb.Image(cfg.kernel.ref), "/boot/vmlinuz")
+			img := llb.Image(cfg.kernel.ref)
+			k.Kernel = build.NewFile(img, "/boot/vmlinuz")
+			// Distro kernels install their config next to the kernel, this is only used for the kernel check.
+			k.Config = build.NewFile(img, "/boot/config-*")
 		case "local":
 			st := llb.Local(kernelImageContext, llb.FollowPaths([]string{filepath.Base(cfg.kernel.ref)}), llb.IncludePatterns([]string{filepath.Base(cfg.kernel.ref)}))
 			k.Kernel = build.NewFile(st, filepath.Base(cfg.kernel.ref)).WithTarget("/boot/vmlinuz")
@@ -150,3 +351,98 @@ func getKernel(cfg vmImageConfig) (build.Kernel, error) {
 
 	return k, nil
 }
+
+// kernelLock is the content of the kernel lock file.
+// It pins a kernel version spec to a specific release so builds are reproducible.
+type kernelLock struct {
+	Spec string `json:"spec"`
+	build.KernelRelease
+}
+
+// resolveKernelRelease resolves the kernel version spec to a specific release.
+// When a lock file is configured and matches the spec, the locked release is used, otherwise the resolved release is written to it.
+func resolveKernelRelease(ctx context.Context, client gateway.Client, cfg vmImageConfig) (build.KernelRelease, error) {
+	if cfg.kernelLock != "" {
+		dt, err := os.ReadFile(cfg.kernelLock)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return build.KernelRelease{}, fmt.Errorf("error reading kernel lock file: %w", err)
+		}
+		if err == nil {
+			var lock kernelLock
+			if err := json.Unmarshal(dt, &lock); err != nil {
+				return build.KernelRelease{}, fmt.Errorf("error parsing kernel lock file %s: %w", cfg.kernelLock, err)
+			}
+			if lock.Spec == cfg.kernel.ref {
+				logrus.WithField("version", lock.Version).WithField("checksum", lock.Checksum).Debug("Using locked kernel release")
+				return lock.KernelRelease, nil
+			}
+			logrus.WithField("locked", lock.Spec).Info("Kernel lock file does not match the requested version, updating it")
+		}
+	}
+
+	rel, err := build.ResolveKernelVersion(ctx, cfg.kernelIndex, cfg.kernel.ref)
+	if err != nil {
+		return rel, err
+	}
+
+	rel.Checksum, err = kernelSourceChecksum(ctx, client, build.GetKernelSourceFromRelease(rel))
+	if err != nil {
+		return rel, err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"spec":     cfg.kernel.ref,
+		"version":  rel.Version,
+		"source":   rel.Source,
+		"checksum": rel.Checksum,
+	}).Info("Resolved kernel release")
+
+	if cfg.kernelLock != "" {
+		dt, err := json.MarshalIndent(kernelLock{Spec: cfg.kernel.ref, KernelRelease: rel}, "", "\t")
+		if err != nil {
+			return rel, err
+		}
+		if err := os.WriteFile(cfg.kernelLock, append(dt, '\n'), 0644); err != nil {
+			return rel, fmt.Errorf("error writing kernel lock file: %w", err)
+		}
+	}
+	return rel, nil
+}
+
+// kernelSourceChecksum gets the sha256 digest of the kernel source tarball.
+func kernelSourceChecksum(ctx context.Context, client gateway.Client, src build.File) (digest.Digest, error) {
+	const checksumPath = "/tmp/checksum"
+
+	st := llb.Image(build.JammyRef).Run(
+		llb.AddMount("/tmp/kernel.tar", src.State(), llb.Readonly, llb.SourcePath(src.Target())),
+		llb.Args([]string{"/bin/sh", "-c", "sha256sum /tmp/kernel.tar | cut -d' ' -f1 > " + checksumPath}),
+	).Root()
+
+	def, err := st.Marshal(ctx)
+	if err != nil {
+		return "", fmt.Errorf("error marshaling kernel checksum LLB: %w", err)
+	}
+
+	res, err := client.Solve(ctx, gateway.SolveRequest{
+		Definition: def.ToPB(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("error getting kernel source checksum: %w", err)
+	}
+
+	ref, err := res.SingleRef()
+	if err != nil {
+		return "", err
+	}
+
+	dt, err := ref.ReadFile(ctx, gateway.ReadRequest{Filename: checksumPath})
+	if err != nil {
+		return "", fmt.Errorf("error reading kernel source checksum: %w", err)
+	}
+
+	dgst := digest.NewDigestFromEncoded(digest.SHA256, strings.TrimSpace(string(dt)))
+	if err := dgst.Validate(); err != nil {
+		return "", fmt.Errorf("invalid kernel source checksum: %w", err)
+	}
+	return dgst, nil
+}
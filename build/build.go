@@ -92,16 +92,27 @@ type Kernel struct {
 type DiskImageSpec struct {
 	Kernel Kernel
 	Rootfs llb.State
-	Size   int64
+	Disk   DiskConfig
 }
 
 func (s *DiskImageSpec) Build() File {
-	st := s.Rootfs
-	// TODO: It'd be great to not have to bake this into the qcow image because this adds a lot of overhead anytime the modules change.
+	return QcowFrom(s.Rootfs, s.Disk)
+}
+
+// KernelDisk builds the disk image which is used to provide the kernel modules, image, and config to the VM.
+// This is kept separate from the rootfs so that changing the kernel does not require rebuilding the rootfs image.
+func (s *DiskImageSpec) KernelDisk() File {
+	st := llb.Scratch()
 	if !s.Kernel.Modules.IsEmpty() {
-		st = s.Kernel.Modules.CopyTo(st)
+		st = s.Kernel.Modules.WithTarget("/lib/modules").CopyTo(st)
+	}
+	if !s.Kernel.Kernel.IsEmpty() {
+		st = s.Kernel.Kernel.WithTarget("/boot/vmlinuz").CopyTo(st)
+	}
+	if !s.Kernel.Config.IsEmpty() {
+		st = s.Kernel.Config.WithTarget("/boot/config").CopyTo(st)
 	}
-	return QcowFrom(st, s.Size)
+	return KernelDiskFrom(st)
 }
 
 type createParentsCopyOption struct{}
@@ -49,13 +49,17 @@ func ParseKernelVersion(version string) (KernelVersion, error) {
 	}
 
 	split = strings.Split(split[1], "-")
-	if len(split) == 1 {
-		return KernelVersion{}, fmt.Errorf("invalid kernel version: %s", version)
-	}
 	minor, err = strconv.Atoi(split[0])
 	if err != nil {
 		return KernelVersion{}, fmt.Errorf("invalid kernel version: %s", version)
 	}
+	if len(split) == 1 {
+		// The first release of a series, e.g. 6.5, has no patch version
+		return KernelVersion{
+			Major: major,
+			Minor: minor,
+		}, nil
+	}
 	if !strings.HasPrefix(split[1], "rc") {
 		return KernelVersion{}, fmt.Errorf("invalid kernel version: %s", version)
 	}
@@ -78,27 +82,31 @@ func ParseKernelVersion(version string) (KernelVersion, error) {
 }
 
 func GetKernelSource(version string) (File, error) {
-	ver, err := ParseKernelVersion(version)
+	rel, err := KernelReleaseFor(version)
 	if err != nil {
 		return File{}, err
 	}
+	return GetKernelSourceFromRelease(rel), nil
+}
 
-	const (
-		rcPattern = "https://git.kernel.org/torvalds/t/linux-%d.%d-rc%d.tar.gz"
-		gaPattern = "https://cdn.kernel.org/pub/linux/kernel/v%d.x/linux-%s.tar.gz"
-	)
-	var url string
-	if ver.IsRC {
-		url = fmt.Sprintf(rcPattern, ver.Major, ver.Minor, ver.RC)
-	} else {
-		url = fmt.Sprintf(gaPattern, ver.Major, version)
+// KernelSourcePath is the path of the kernel source tarball in the state returned by GetKernelSourceFromRelease.
+const KernelSourcePath = "/kernel.tar"
+
+// GetKernelSourceFromRelease returns the source tarball for the kernel release.
+// If the release has a checksum the download is verified against it.
+func GetKernelSourceFromRelease(rel KernelRelease) File {
+	opts := []llb.HTTPOption{llb.Filename(strings.TrimPrefix(KernelSourcePath, "/"))}
+	if rel.Checksum != "" {
+		opts = append(opts, llb.Checksum(rel.Checksum))
 	}
-	return NewFile(llb.HTTP(url, llb.Filename("kernel.tar.gz")), "/kernel.tar.gz"), nil
+	return NewFile(llb.HTTP(rel.Source, opts...), KernelSourcePath)
 }
 
 // BaseKernelOptions are used when building the kernel w/o a custom config.
 // We take the minimal `tinyconfig` and add these on top.
-var BaseKernelOptions = map[string]string{
+// The options needed by the workloads and shared mounts (see KernelRequirementsFor) are always included, so the kernel passes the kernel check.
+// olddefconfig drops options whose Kconfig dependencies are not set, so those must be included as well (e.g. CONFIG_NETFILTER).
+var BaseKernelOptions = withRequiredKernelOptions(map[string]string{
 	"CONFIG_BINFMT_ELF":                   "y",
 	"CONFIG_BLOCK":                        "y",
 	"CONFIG_BLK_DEV":                      "y",
@@ -119,7 +127,7 @@ var BaseKernelOptions = map[string]string{
 	"CONFIG_IP_NF_NAT":                    "y",
 	"CONFIG_IP_NF_TARGET_MASQUERADE":      "y",
 	"CONFIG_IP_VALN":                      "m",
-	"CONFIG_IP_VS":                        "m",
+	"CONFIG_IP_VS":                        "y",
 	"CONFIG_IP_VS_RR":                     "y",
 	"CONFIG_KEYS":                         "y",
 	"CONFIG_MACVLAN":                      "m",
@@ -128,6 +136,9 @@ var BaseKernelOptions = map[string]string{
 	"CONFIG_MODULES":                      "y",
 	"CONFIG_NAMESPACES":                   "y",
 	"CONFIG_NET":                          "y",
+	"CONFIG_NETFILTER":                    "y",
+	"CONFIG_NETFILTER_ADVANCED":           "y",
+	"CONFIG_NETFILTER_XTABLES":            "y",
 	"CONFIG_NETFILTER_XT_MATCH_ADDRTYPE":  "y",
 	"CONFIG_NETFILTER_XT_MATCH_CONNTRACK": "y",
 	"CONFIG_NETFILTER_XT_MATCH_IPVS":      "y",
@@ -135,9 +146,12 @@ var BaseKernelOptions = map[string]string{
 	"CONFIG_NETDEVICES":                   "y",
 	"CONFIG_NET_CORE":                     "y",
 	"CONFIG_NET_NS":                       "y",
+	"CONFIG_NF_CONNTRACK":                 "y",
+	"CONFIG_NF_NAT":                       "y",
 	"CONFIG_OVERLAY_FS":                   "m",
 	"CONFIG_PID_NS":                       "y",
 	"CONFIG_POSIX_MQUEUE":                 "y",
+	"CONFIG_SMP":                          "y",
 	"CONFIG_TTY":                          "y",
 	"CONFIG_UTS_NS":                       "y",
 	"CONFIG_USER_NS":                      "y",
@@ -145,9 +159,15 @@ var BaseKernelOptions = map[string]string{
 	"CONFIG_VXLAN":                        "m",
 	"CONFIG_XFRM":                         "y",
 	"CONFIG_9P_FS":                        "y",
+	"CONFIG_BPF_SYSCALL":                  "y",
+	"CONFIG_DEBUG_INFO_BTF":               "y",
+	"CONFIG_DEBUG_INFO_DWARF4":            "y",
 	"CONFIG_DEBUG_KERNEL":                 "y",
 	"CONFIG_DRM_VIRTIO_GPU":               "y",
+	"CONFIG_FUSE_FS":                      "y",
 	"CONFIG_HYPERVISOR_GUEST":             "y",
+	"CONFIG_IKCONFIG":                     "y",
+	"CONFIG_IKCONFIG_PROC":                "y",
 	"CONFIG_INET":                         "y",
 	"CONFIG_IP_PNP":                       "y",
 	"CONFIG_IP_PNP_DHCP":                  "y",
@@ -166,10 +186,31 @@ var BaseKernelOptions = map[string]string{
 	"CONFIG_VIRTUALIZATION":               "y",
 	"CONFIG_VIRTIO":                       "y",
 	"CONFIG_VIRTIO_BLK":                   "y",
+	"CONFIG_VIRTIO_FS":                    "y",
 	"CONFIG_VIRTIO_CONSOLE":               "y",
 	"CONFIG_VIRTIO_INPUT":                 "y",
 	"CONFIG_VIRTIO_MENU":                  "y",
 	"CONFIG_VIRTIO_NET":                   "y",
+	"CONFIG_VIRTIO_MMIO":                  "y",
+	"CONFIG_VIRTIO_PCI":                   "y",
+})
+
+// withRequiredKernelOptions adds the kernel options needed by any workload or shared mount to the passed in options.
+// Options which are already set are left as is.
+func withRequiredKernelOptions(opts map[string]string) map[string]string {
+	required := append(CgroupKernelOptions(1), CgroupKernelOptions(2)...)
+	for _, w := range Workloads {
+		required = append(required, w.KernelOptions...)
+	}
+	for _, mountOpts := range MountKernelOptions {
+		required = append(required, mountOpts...)
+	}
+	for _, opt := range required {
+		if _, ok := opts[opt]; !ok {
+			opts[opt] = "y"
+		}
+	}
+	return opts
 }
 
 func BuildKernel(container llb.State, source File, config *File) (kernelCfg File, vmlinuz File, modules Directory) {
@@ -184,8 +225,8 @@ printversion:
 		Run(llb.Shlex("mkdir -p /opt/src/kernel")).
 		Dir("/opt/src/kernel").
 		Run(
-			llb.AddMount("/opt/src/kernel.tar.gz", source.State(), llb.Readonly, llb.SourcePath("/kernel.tar.gz")),
-			llb.Shlex("tar -C /opt/src/kernel --strip-components=1 -xzf /opt/src/kernel.tar.gz"),
+			llb.AddMount("/opt/src/kernel.tar", source.State(), llb.Readonly, llb.SourcePath(source.Target())),
+			llb.Shlex("tar -C /opt/src/kernel --strip-components=1 -xf /opt/src/kernel.tar"),
 		).
 		File(llb.Mkfile("/tmp/version.mk", 0644, []byte(version))).
 		Run(llb.Args([]string{"/bin/sh", "-c", "cat /tmp/version.mk >> /opt/src/kernel/Makefile"})).Root()
@@ -229,7 +270,7 @@ func KernelBuildBase() llb.State {
 		Run(
 			llb.Args([]string{
 				"/bin/sh", "-c",
-				"apt-get update && apt-get install -y build-essential bc libncurses-dev bison flex libssl-dev libelf-dev ccache kmod rsync",
+				"apt-get update && apt-get install -y build-essential bc libncurses-dev bison flex libssl-dev libelf-dev ccache kmod rsync dwarves xz-utils",
 			}),
 		).Root()
 }
@@ -2,6 +2,8 @@ package build
 
 import (
 	"context"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	bkclient "github.com/moby/buildkit/client"
@@ -43,3 +45,206 @@ func TestBuildKernel(t *testing.T) {
 	}
 	<-done
 }
+
+func TestCheckKernelConfig(t *testing.T) {
+	cfg := ParseKernelConfig([]byte(`
+# Automatically generated file; DO NOT EDIT.
+CONFIG_CGROUPS=y
+CONFIG_MEMCG=m
+# CONFIG_CGROUP_BPF is not set
+CONFIG_LOCALVERSION=""
+`))
+
+	res := CheckKernelConfig(cfg, []string{"CONFIG_CGROUPS", "CONFIG_MEMCG", "CONFIG_CGROUP_BPF", "CONFIG_CGROUPS"})
+	if len(res.Missing) != 1 || res.Missing[0] != "CONFIG_CGROUP_BPF" {
+		t.Errorf("unexpected missing options: %v", res.Missing)
+	}
+	if len(res.Modules) != 1 || res.Modules[0] != "CONFIG_MEMCG" {
+		t.Errorf("unexpected module options: %v", res.Modules)
+	}
+}
+
+// kconfigDeps are the Kconfig dependencies ("depends on") of the kernel options needed by the workloads and shared mounts,
+// and of those dependencies in turn.
+// tinyconfig sets none of them and olddefconfig drops options whose dependencies are not set.
+var kconfigDeps = map[string][]string{
+	"CONFIG_CGROUPS":                      nil,
+	"CONFIG_CGROUP_BPF":                   {"CONFIG_CGROUPS", "CONFIG_BPF_SYSCALL"},
+	"CONFIG_CGROUP_CPUACCT":               {"CONFIG_CGROUPS"},
+	"CONFIG_CGROUP_DEVICE":                {"CONFIG_CGROUPS"},
+	"CONFIG_CGROUP_FREEZER":               {"CONFIG_CGROUPS"},
+	"CONFIG_CGROUP_PIDS":                  {"CONFIG_CGROUPS"},
+	"CONFIG_CGROUP_SCHED":                 {"CONFIG_CGROUPS"},
+	"CONFIG_CPUSETS":                      {"CONFIG_CGROUPS", "CONFIG_SMP"},
+	"CONFIG_MEMCG":                        {"CONFIG_CGROUPS"},
+	"CONFIG_BPF_SYSCALL":                  nil,
+	"CONFIG_SMP":                          nil,
+	"CONFIG_NAMESPACES":                   nil,
+	"CONFIG_IPC_NS":                       {"CONFIG_NAMESPACES", "CONFIG_POSIX_MQUEUE"},
+	"CONFIG_NET_NS":                       {"CONFIG_NAMESPACES", "CONFIG_NET"},
+	"CONFIG_PID_NS":                       {"CONFIG_NAMESPACES"},
+	"CONFIG_UTS_NS":                       {"CONFIG_NAMESPACES"},
+	"CONFIG_KEYS":                         nil,
+	"CONFIG_POSIX_MQUEUE":                 {"CONFIG_NET"},
+	"CONFIG_NET":                          nil,
+	"CONFIG_INET":                         {"CONFIG_NET"},
+	"CONFIG_NETDEVICES":                   {"CONFIG_NET"},
+	"CONFIG_NET_CORE":                     {"CONFIG_NETDEVICES"},
+	"CONFIG_VETH":                         {"CONFIG_NET_CORE"},
+	"CONFIG_BRIDGE":                       {"CONFIG_NET", "CONFIG_INET"},
+	"CONFIG_BRIDGE_NETFILTER":             {"CONFIG_INET", "CONFIG_BRIDGE", "CONFIG_NETFILTER", "CONFIG_NETFILTER_ADVANCED"},
+	"CONFIG_NETFILTER":                    {"CONFIG_NET"},
+	"CONFIG_NETFILTER_ADVANCED":           {"CONFIG_NETFILTER"},
+	"CONFIG_NETFILTER_XTABLES":            {"CONFIG_NETFILTER"},
+	"CONFIG_NF_CONNTRACK":                 {"CONFIG_NETFILTER"},
+	"CONFIG_NF_NAT":                       {"CONFIG_NF_CONNTRACK"},
+	"CONFIG_NF_CT_NETLINK":                {"CONFIG_NF_CONNTRACK"},
+	"CONFIG_IP_VS":                        {"CONFIG_NET", "CONFIG_INET", "CONFIG_NETFILTER"},
+	"CONFIG_IP_NF_IPTABLES":               {"CONFIG_INET", "CONFIG_NETFILTER", "CONFIG_NETFILTER_XTABLES"},
+	"CONFIG_IP_NF_FILTER":                 {"CONFIG_IP_NF_IPTABLES"},
+	"CONFIG_IP_NF_TARGET_REJECT":          {"CONFIG_IP_NF_FILTER"},
+	"CONFIG_IP_NF_NAT":                    {"CONFIG_NF_CONNTRACK", "CONFIG_IP_NF_IPTABLES", "CONFIG_NF_NAT"},
+	"CONFIG_IP_NF_TARGET_MASQUERADE":      {"CONFIG_IP_NF_NAT"},
+	"CONFIG_NETFILTER_XT_MARK":            {"CONFIG_NETFILTER_XTABLES", "CONFIG_NETFILTER_ADVANCED"},
+	"CONFIG_NETFILTER_XT_MATCH_ADDRTYPE":  {"CONFIG_NETFILTER_XTABLES", "CONFIG_NETFILTER_ADVANCED"},
+	"CONFIG_NETFILTER_XT_MATCH_CONNTRACK": {"CONFIG_NETFILTER_XTABLES", "CONFIG_NF_CONNTRACK"},
+	"CONFIG_NETFILTER_XT_MATCH_IPVS":      {"CONFIG_NETFILTER_XTABLES", "CONFIG_NETFILTER_ADVANCED", "CONFIG_IP_VS"},
+	"CONFIG_NETFILTER_XT_MATCH_STATE":     {"CONFIG_NETFILTER_XTABLES", "CONFIG_NETFILTER_ADVANCED", "CONFIG_NF_CONNTRACK"},
+	"CONFIG_NETFILTER_XT_MATCH_U32":       {"CONFIG_NETFILTER_XTABLES", "CONFIG_NETFILTER_ADVANCED"},
+	"CONFIG_OVERLAY_FS":                   nil,
+	"CONFIG_FUSE_FS":                      nil,
+	"CONFIG_VIRTIO_FS":                    {"CONFIG_FUSE_FS", "CONFIG_VIRTIO"},
+	// VIRTIO has no prompt, it is selected by the transports.
+	"CONFIG_VIRTIO":              {"CONFIG_VIRTIO_PCI", "CONFIG_VIRTIO_MMIO"},
+	"CONFIG_VIRTIO_PCI":          {"CONFIG_PCI", "CONFIG_VIRTIO_MENU"},
+	"CONFIG_VIRTIO_MMIO":         {"CONFIG_VIRTIO_MENU"},
+	"CONFIG_VIRTIO_MENU":         nil,
+	"CONFIG_PCI":                 nil,
+	"CONFIG_NET_9P":              {"CONFIG_NET"},
+	"CONFIG_NET_9P_VIRTIO":       {"CONFIG_NET_9P", "CONFIG_VIRTIO"},
+	"CONFIG_9P_FS":               {"CONFIG_NET_9P", "CONFIG_NETWORK_FILESYSTEMS"},
+	"CONFIG_NETWORK_FILESYSTEMS": nil,
+}
+
+// TestBaseKernelOptionsDependencies checks that the options the kernel check requires survive olddefconfig,
+// i.e. that their Kconfig dependencies are part of the base options too.
+func TestBaseKernelOptionsDependencies(t *testing.T) {
+	required := append(CgroupKernelOptions(1), CgroupKernelOptions(2)...)
+	for _, w := range Workloads {
+		required = append(required, w.KernelOptions...)
+	}
+	for _, opts := range MountKernelOptions {
+		required = append(required, opts...)
+	}
+
+	checked := make(map[string]bool)
+	var check func(opt string)
+	check = func(opt string) {
+		if checked[opt] {
+			return
+		}
+		checked[opt] = true
+
+		deps, ok := kconfigDeps[opt]
+		if !ok {
+			t.Errorf("no Kconfig dependencies for %s, add them to kconfigDeps", opt)
+			return
+		}
+		for _, dep := range deps {
+			switch v := BaseKernelOptions[dep]; {
+			case v == "" || v == "n":
+				t.Errorf("%s depends on %s, which is not set in the base kernel options", opt, dep)
+			case v == "m" && BaseKernelOptions[opt] == "y":
+				t.Errorf("%s is built in but depends on %s, which is a module", opt, dep)
+			}
+			check(dep)
+		}
+	}
+	for _, opt := range required {
+		check(opt)
+	}
+
+	for _, mod := range MobyKernelMods {
+		if _, ok := kernelModOptions[mod]; !ok {
+			t.Errorf("no kernel option for module %s", mod)
+		}
+	}
+}
+
+func TestParseKernelVersion(t *testing.T) {
+	cases := map[string]KernelVersion{
+		"6.5":      {Major: 6, Minor: 5},
+		"6.5.7":    {Major: 6, Minor: 5, Patch: 7},
+		"6.6-rc6":  {Major: 6, Minor: 6, RC: 6, IsRC: true},
+		"5.10.198": {Major: 5, Minor: 10, Patch: 198},
+	}
+	for in, expected := range cases {
+		ver, err := ParseKernelVersion(in)
+		if err != nil {
+			t.Errorf("%s: %v", in, err)
+			continue
+		}
+		if ver != expected {
+			t.Errorf("%s: expected %+v, got %+v", in, expected, ver)
+		}
+	}
+
+	for _, in := range []string{"6", "latest", "6.6-foo", "6.x"} {
+		if _, err := ParseKernelVersion(in); err == nil {
+			t.Errorf("%s: expected error", in)
+		}
+	}
+}
+
+const testReleaseIndex = `{
+	"latest_stable": {"version": "6.5.7"},
+	"releases": [
+		{"moniker": "mainline", "version": "6.6-rc6", "source": "https://example.com/linux-6.6-rc6.tar.gz"},
+		{"moniker": "stable", "version": "6.5.7", "source": "https://example.com/linux-6.5.7.tar.xz"},
+		{"moniker": "longterm", "version": "6.1.58", "source": "https://example.com/linux-6.1.58.tar.xz"},
+		{"moniker": "longterm", "version": "5.15.135", "source": "https://example.com/linux-5.15.135.tar.xz"}
+	]
+}`
+
+func TestResolveKernelVersion(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testReleaseIndex))
+	}))
+	defer srv.Close()
+
+	cases := map[string]string{
+		"latest":          "6.6-rc6",
+		"stable":          "6.5.7",
+		"longterm":        "6.1.58",
+		"longterm/5.15":   "5.15.135",
+		"6.5":             "6.5.7",
+		"6.4":             "",
+		"6.2.2":           "6.2.2",
+		"longterm/6.1":    "6.1.58",
+		"6.1":             "6.1.58",
+		"5.15":            "5.15.135",
+		"6.7-rc1":         "6.7-rc1",
+		"longterm/5.10.1": "",
+	}
+
+	ctx := context.Background()
+	for in, expected := range cases {
+		rel, err := ResolveKernelVersion(ctx, srv.URL, in)
+		if expected == "" {
+			if err == nil {
+				t.Errorf("%s: expected error, got %+v", in, rel)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", in, err)
+			continue
+		}
+		if rel.Version != expected {
+			t.Errorf("%s: expected version %s, got %s", in, expected, rel.Version)
+		}
+		if rel.Source == "" {
+			t.Errorf("%s: expected source url", in)
+		}
+	}
+}
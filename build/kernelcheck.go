@@ -0,0 +1,159 @@
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"sort"
+	"strings"
+
+	"github.com/cpuguy83/qemu-micro-env/build/vmconfig"
+)
+
+// kernelModOptions maps kernel modules to the kernel option which provides them.
+var kernelModOptions = map[string]string{
+	"br_netfilter":         "CONFIG_BRIDGE_NETFILTER",
+	"ip_conntrack":         "CONFIG_NF_CONNTRACK",
+	"ip_tables":            "CONFIG_IP_NF_IPTABLES",
+	"ipt_conntrack":        "CONFIG_NETFILTER_XT_MATCH_CONNTRACK",
+	"ipt_MASQUERADE":       "CONFIG_IP_NF_TARGET_MASQUERADE",
+	"ipt_REJECT":           "CONFIG_IP_NF_TARGET_REJECT",
+	"ipt_state":            "CONFIG_NETFILTER_XT_MATCH_STATE",
+	"iptable_filter":       "CONFIG_IP_NF_FILTER",
+	"iptable_nat":          "CONFIG_IP_NF_NAT",
+	"overlay":              "CONFIG_OVERLAY_FS",
+	"nf_conntrack":         "CONFIG_NF_CONNTRACK",
+	"nf_conntrack_netlink": "CONFIG_NF_CT_NETLINK",
+	"xt_addrtype":          "CONFIG_NETFILTER_XT_MATCH_ADDRTYPE",
+	"xt_u32":               "CONFIG_NETFILTER_XT_MATCH_U32",
+	"veth":                 "CONFIG_VETH",
+}
+
+// KernelModOptions returns the kernel options which provide the passed in modules.
+func KernelModOptions(mods []string) []string {
+	var opts []string
+	for _, mod := range mods {
+		if opt, ok := kernelModOptions[mod]; ok {
+			opts = append(opts, opt)
+		}
+	}
+	return opts
+}
+
+// MobyKernelOptions are the kernel options dockerd needs to function.
+// This is the "Generally Necessary" section of moby's contrib/check-config.sh: the options for the modules dockerd loads,
+// plus the ones which are not modules.
+var MobyKernelOptions = append([]string{
+	"CONFIG_NAMESPACES",
+	"CONFIG_NET_NS",
+	"CONFIG_PID_NS",
+	"CONFIG_IPC_NS",
+	"CONFIG_UTS_NS",
+	"CONFIG_KEYS",
+	"CONFIG_BRIDGE",
+	"CONFIG_NETFILTER_XT_MATCH_IPVS",
+	"CONFIG_NETFILTER_XT_MARK",
+	"CONFIG_NF_NAT",
+	"CONFIG_POSIX_MQUEUE",
+}, KernelModOptions(MobyKernelMods)...)
+
+// OverlayKernelOptions are needed for the overlay2 storage driver.
+var OverlayKernelOptions = []string{
+	"CONFIG_OVERLAY_FS",
+}
+
+// MountKernelOptions are the kernel options needed for each type of shared mount, see vmconfig.SharedMount.
+var MountKernelOptions = map[string][]string{
+	vmconfig.MountTypeVirtiofs: {"CONFIG_FUSE_FS", "CONFIG_VIRTIO_FS"},
+	vmconfig.MountType9p:       {"CONFIG_NET_9P", "CONFIG_NET_9P_VIRTIO", "CONFIG_9P_FS"},
+}
+
+// CgroupKernelOptions returns the kernel options needed for the controllers
+// used with the given cgroup version.
+func CgroupKernelOptions(version int) []string {
+	opts := []string{
+		"CONFIG_CGROUPS",
+		"CONFIG_CGROUP_CPUACCT",
+		"CONFIG_CGROUP_PIDS",
+		"CONFIG_CGROUP_SCHED",
+		"CONFIG_CPUSETS",
+		"CONFIG_MEMCG",
+	}
+	if version == 1 {
+		return append(opts, "CONFIG_CGROUP_DEVICE", "CONFIG_CGROUP_FREEZER")
+	}
+	// cgroup v2 has no devices controller, device access is controlled with bpf programs instead.
+	return append(opts, "CONFIG_CGROUP_BPF")
+}
+
+// KernelRequirementsFor returns the kernel options needed to run the given init command in the VM,
+// with shared mounts of the given types.
+func KernelRequirementsFor(initCmd string, cgroupVersion int, mountTypes ...string) []string {
+	opts := CgroupKernelOptions(cgroupVersion)
+	for _, w := range Workloads {
+		if initCmd == w.InitScriptName() {
+			opts = append(opts, w.KernelOptions...)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, t := range mountTypes {
+		if !seen[t] {
+			seen[t] = true
+			opts = append(opts, MountKernelOptions[t]...)
+		}
+	}
+	return opts
+}
+
+// KernelConfig is a parsed kernel config, mapping option names to their values.
+// Options that are not set are not included.
+type KernelConfig map[string]string
+
+// ParseKernelConfig parses the content of a kernel .config file.
+func ParseKernelConfig(dt []byte) KernelConfig {
+	cfg := make(KernelConfig)
+	scanner := bufio.NewScanner(bytes.NewReader(dt))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		cfg[k] = strings.Trim(v, `"`)
+	}
+	return cfg
+}
+
+// KernelCheckResult is the result of checking a kernel config against a set of required options.
+type KernelCheckResult struct {
+	// Missing are options that are not enabled at all.
+	Missing []string
+	// Modules are options that are only available as a module.
+	// These work only if the module is available in the VM and gets loaded.
+	Modules []string
+}
+
+// CheckKernelConfig checks that all the required options are enabled in the kernel config.
+func CheckKernelConfig(cfg KernelConfig, required []string) KernelCheckResult {
+	var res KernelCheckResult
+	seen := make(map[string]bool, len(required))
+	for _, opt := range required {
+		if seen[opt] {
+			continue
+		}
+		seen[opt] = true
+
+		switch cfg[opt] {
+		case "y":
+		case "m":
+			res.Modules = append(res.Modules, opt)
+		default:
+			res.Missing = append(res.Missing, opt)
+		}
+	}
+	sort.Strings(res.Missing)
+	sort.Strings(res.Modules)
+	return res
+}
@@ -0,0 +1,137 @@
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// KernelReleasesURL is the default index used to resolve kernel version aliases.
+var KernelReleasesURL = "https://www.kernel.org/releases.json"
+
+const (
+	kernelAliasLatest   = "latest"
+	kernelAliasStable   = "stable"
+	kernelAliasLongterm = "longterm"
+)
+
+// KernelRelease is a specific kernel version along with where to get the source for it.
+type KernelRelease struct {
+	Version  string        `json:"version"`
+	Source   string        `json:"source"`
+	Checksum digest.Digest `json:"checksum,omitempty"`
+}
+
+// KernelReleaseFor returns the release for a fully qualified kernel version (e.g. 6.5, 6.5.7, or 6.6-rc6).
+// This does not include a checksum.
+func KernelReleaseFor(version string) (KernelRelease, error) {
+	ver, err := ParseKernelVersion(version)
+	if err != nil {
+		return KernelRelease{}, err
+	}
+
+	const (
+		rcPattern = "https://git.kernel.org/torvalds/t/linux-%d.%d-rc%d.tar.gz"
+		gaPattern = "https://cdn.kernel.org/pub/linux/kernel/v%d.x/linux-%s.tar.gz"
+	)
+	var url string
+	if ver.IsRC {
+		url = fmt.Sprintf(rcPattern, ver.Major, ver.Minor, ver.RC)
+	} else {
+		url = fmt.Sprintf(gaPattern, ver.Major, version)
+	}
+	return KernelRelease{Version: version, Source: url}, nil
+}
+
+// IsKernelAlias returns true if the version needs to be resolved against a release index.
+// These are "latest", "stable", "longterm[/<major>.<minor>]" and "<major>.<minor>" (latest patch release of the series).
+func IsKernelAlias(version string) bool {
+	switch version {
+	case kernelAliasLatest, kernelAliasStable, kernelAliasLongterm:
+		return true
+	}
+	if strings.HasPrefix(version, kernelAliasLongterm+"/") {
+		return true
+	}
+	ver, err := ParseKernelVersion(version)
+	return err == nil && !ver.IsRC && strings.Count(version, ".") == 1
+}
+
+type kernelReleaseIndex struct {
+	LatestStable struct {
+		Version string `json:"version"`
+	} `json:"latest_stable"`
+	Releases []struct {
+		Moniker string `json:"moniker"`
+		Version string `json:"version"`
+		Source  string `json:"source"`
+	} `json:"releases"`
+}
+
+// ResolveKernelVersion resolves a kernel version alias (see IsKernelAlias) using the kernel.org style releases.json index at indexURL.
+// "latest" is the latest mainline release (which may be a release candidate).
+// If the version is not an alias it is returned as is.
+func ResolveKernelVersion(ctx context.Context, indexURL, version string) (KernelRelease, error) {
+	if !IsKernelAlias(version) {
+		return KernelReleaseFor(version)
+	}
+
+	if indexURL == "" {
+		indexURL = KernelReleasesURL
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, indexURL, nil)
+	if err != nil {
+		return KernelRelease{}, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return KernelRelease{}, fmt.Errorf("error fetching kernel release index: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return KernelRelease{}, fmt.Errorf("error fetching kernel release index %s: %s", indexURL, resp.Status)
+	}
+
+	var idx kernelReleaseIndex
+	if err := json.NewDecoder(resp.Body).Decode(&idx); err != nil {
+		return KernelRelease{}, fmt.Errorf("error decoding kernel release index: %w", err)
+	}
+
+	// The index is ordered from newest to oldest, so the first match is what we want.
+	for _, r := range idx.Releases {
+		var match bool
+		switch {
+		case version == kernelAliasLatest:
+			match = r.Moniker == "mainline"
+		case version == kernelAliasStable:
+			match = r.Version == idx.LatestStable.Version
+		case version == kernelAliasLongterm:
+			match = r.Moniker == kernelAliasLongterm
+		case strings.HasPrefix(version, kernelAliasLongterm+"/"):
+			series := strings.TrimPrefix(version, kernelAliasLongterm+"/")
+			match = r.Moniker == kernelAliasLongterm && inKernelSeries(r.Version, series)
+		default:
+			match = inKernelSeries(r.Version, version)
+		}
+		if match {
+			return KernelRelease{Version: r.Version, Source: r.Source}, nil
+		}
+	}
+
+	if strings.Count(version, ".") == 1 {
+		// The index only tracks the supported series, the latest patch release of older ones is unknown.
+		return KernelRelease{}, fmt.Errorf("%w: %q is not tracked in %s, specify the full version (<major>.<minor>.<patch>) instead", errKernelVersionInvalid, version, indexURL)
+	}
+	return KernelRelease{}, fmt.Errorf("%w: no release found for %q in %s", errKernelVersionInvalid, version, indexURL)
+}
+
+// inKernelSeries checks if the version is a (non-rc) release of the <major>.<minor> series.
+func inKernelSeries(version, series string) bool {
+	return version == series || strings.HasPrefix(version, series+".")
+}
@@ -3,6 +3,7 @@ package build
 import (
 	"bytes"
 	"fmt"
+	"path"
 	"strings"
 
 	"github.com/moby/buildkit/client/llb"
@@ -10,19 +11,84 @@ import (
 
 var MobyRef = "docker:23-dind"
 
+// MobyStaticURL is the default base URL for static:// moby releases.
+// Releases are downloaded from <url>/<arch>/docker-<version>.tgz.
+var MobyStaticURL = "https://download.docker.com/linux/static/stable"
+
+// MobyBinaries are the binaries that make up a moby install.
+var MobyBinaries = []string{"docker", "dockerd", "docker-init", "docker-proxy", "containerd", "containerd-shim-runc-v2", "runc"}
+
 const getCmdPaths = `
 mkdir -p /tmp/output
-commands="docker dockerd docker-init docker-proxy containerd containerd-shim-runc-v2 runc"
-for i in ${commands}; do
+for i in ${MOBY_BINARIES}; do
 	cmd="$(command -v ${i})"
 	if [ $? -ne 0 ]; then
 		[ -f "/${i}" ] || exit 1
-		cmd = "/${i}"
+		cmd="/${i}"
 	fi
 	mv "${cmd}" "/tmp/output/${i}"
 done
 `
 
+// getStatic downloads and extracts a static release tarball.
+const getStatic = `
+mkdir -p /tmp/static /tmp/output
+wget -q -O- "${MOBY_URL}/$(uname -m)/docker-${MOBY_VERSION}.tgz" | tar -xz -C /tmp/static --strip-components=1
+for i in ${MOBY_BINARIES}; do
+	[ -f "/tmp/static/${i}" ] || continue
+	mv "/tmp/static/${i}" "/tmp/output/${i}"
+done
+`
+
+// getLocal finds the moby binaries in a local directory (such as the bundles dir of a moby build), wherever they are.
+// Binaries that are not found are taken from the default moby image.
+// It fails when none of the binaries are found, since that is most likely the wrong dir.
+const getLocal = `
+n=0
+for i in ${MOBY_BINARIES}; do
+	found="$(find /tmp/local -name "${i}" \( -type f -o -type l \) | head -n1)"
+	if [ -n "${found}" ]; then
+		cp -L "${found}" "/tmp/output/${i}"
+		chmod +x "/tmp/output/${i}"
+		n=$((n + 1))
+	fi
+done
+if [ "${n}" -eq 0 ]; then
+	echo "none of the moby binaries (${MOBY_BINARIES}) were found in the local dir" >&2
+	exit 1
+fi
+`
+
+// MobyOpt configures how GetMoby gets the moby binaries.
+type MobyOpt func(*mobyConfig)
+
+type mobyConfig struct {
+	staticURL string
+	local     llb.State
+	binaries  []string
+}
+
+// WithMobyStaticURL sets the base URL for static:// releases.
+func WithMobyStaticURL(u string) MobyOpt {
+	return func(cfg *mobyConfig) {
+		cfg.staticURL = u
+	}
+}
+
+// WithMobyBinaries limits the binaries that are taken from the moby source, defaults to MobyBinaries.
+func WithMobyBinaries(bins ...string) MobyOpt {
+	return func(cfg *mobyConfig) {
+		cfg.binaries = bins
+	}
+}
+
+// WithMobyLocal sets the source of local:// binaries.
+func WithMobyLocal(st llb.State) MobyOpt {
+	return func(cfg *mobyConfig) {
+		cfg.local = st
+	}
+}
+
 var MobyKernelMods = []string{
 	"br_netfilter",
 	"ip_conntrack",
@@ -41,42 +107,76 @@ var MobyKernelMods = []string{
 	"veth",
 }
 
-var DockerdInitScriptName = "/usr/local/bin/dockerd-init"
-
-func DockerdInitScript() File {
+// initScript creates a script which loads the kernel modules and then execs the passed in command.
+func initScript(p string, mods []string, cmd string) File {
 	b := bytes.NewBuffer(nil)
 	b.WriteString("#!/bin/sh\n\n")
 
 	// Don't error out just because the module load fails
-	// Dockerd will either fallback or error out on its own
-	b.WriteString("modprobe -a " + strings.Join(MobyKernelMods, " ") + "\n\n")
+	// The workload will either fallback or error out on its own
+	if len(mods) > 0 {
+		b.WriteString("modprobe -a " + strings.Join(mods, " ") + "\n\n")
+	}
 
 	b.WriteString("echo 1 > /proc/sys/net/ipv4/ip_forward\n")
-	b.WriteString("exec dockerd ${@}\n")
+	b.WriteString("exec " + cmd + "\n")
 
 	return NewFile(llb.Scratch().
-		File(llb.Mkdir("/usr/local/bin", 0755, llb.WithParents(true))).
-		File(llb.Mkfile(DockerdInitScriptName, 0777, b.Bytes())), DockerdInitScriptName)
+		File(llb.Mkdir(path.Dir(p), 0755, llb.WithParents(true))).
+		File(llb.Mkfile(p, 0777, b.Bytes())), p)
 }
 
-func GetMoby(ref string) (llb.State, error) {
+// GetMoby returns a state with the moby binaries in /usr/local/bin.
+// The ref is one of:
+//   - docker-image://<image> (or just <image>): binaries are taken from $PATH or / in the image
+//   - static://<version>: an official static release
+//   - local://<dir>: binaries found in the local dir (see WithMobyLocal), the rest come from the default image.
+//     At least one binary must be found in the dir.
+func GetMoby(ref string, opts ...MobyOpt) (llb.State, error) {
+	cfg := mobyConfig{staticURL: MobyStaticURL, binaries: MobyBinaries}
+	for _, o := range opts {
+		o(&cfg)
+	}
+
 	if ref == "" {
 		ref = MobyRef
 	}
 
-	scheme, parsedRef, ok := strings.Cut("://", ref)
+	scheme, parsedRef, ok := strings.Cut(ref, "://")
 	if !ok {
 		parsedRef = ref
 		scheme = "docker-image"
 	}
 
+	bins := llb.AddEnv("MOBY_BINARIES", strings.Join(cfg.binaries, " "))
+
+	var st llb.State
 	switch scheme {
 	case "docker-image":
 		// supports docker binaries in either $PATH or in /
-		st := llb.Image(parsedRef).
-			Run(llb.Args([]string{"/bin/sh", "-ec", getCmdPaths})).Root()
-		return llb.Scratch().File(llb.Copy(st, "/tmp/output/", "/usr/local/bin/", createParentsCopyOption{}, copyDirContentsOnly{})), nil
+		st = mobyFromImage(parsedRef, bins)
+	case "static":
+		st = llb.Image(DistroAlpine.Ref).
+			Run(
+				bins,
+				llb.AddEnv("MOBY_URL", strings.TrimSuffix(cfg.staticURL, "/")),
+				llb.AddEnv("MOBY_VERSION", strings.TrimPrefix(parsedRef, "v")),
+				llb.Args([]string{"/bin/sh", "-ec", getStatic}),
+			).Root()
+	case "local":
+		st = mobyFromImage(MobyRef, bins).
+			Run(
+				bins,
+				llb.AddMount("/tmp/local", cfg.local, llb.Readonly),
+				llb.Args([]string{"/bin/sh", "-ec", getLocal}),
+			).Root()
 	default:
 		return llb.Scratch(), fmt.Errorf("invalid scheme %q", scheme)
 	}
+	return llb.Scratch().File(llb.Copy(st, "/tmp/output/", "/usr/local/bin/", createParentsCopyOption{}, copyDirContentsOnly{})), nil
+}
+
+func mobyFromImage(ref string, bins llb.StateOption) llb.State {
+	return llb.Image(ref).
+		Run(bins, llb.Args([]string{"/bin/sh", "-ec", getCmdPaths})).Root()
 }
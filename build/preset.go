@@ -0,0 +1,142 @@
+package build
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cpuguy83/qemu-micro-env/build/vmconfig"
+	"github.com/moby/buildkit/client/llb"
+)
+
+var (
+	// K3sVersion is the k3s release installed for the k3s workload.
+	K3sVersion = "v1.27.4+k3s1"
+	// K3sURL is the base URL k3s releases are downloaded from.
+	K3sURL = "https://github.com/k3s-io/k3s/releases/download"
+	// BuildkitRef is the image the buildkitd workload binaries are taken from.
+	BuildkitRef = "moby/buildkit:v0.11.5"
+)
+
+// ContainerdKernelMods are the kernel modules containerd needs without CNI networking.
+var ContainerdKernelMods = []string{
+	"overlay",
+}
+
+// getK3s downloads the k3s binary for the current architecture.
+const getK3s = `
+mkdir -p /tmp/output
+suffix=""
+case "$(uname -m)" in
+	aarch64) suffix="-arm64" ;;
+	armv7l) suffix="-armhf" ;;
+esac
+wget -q -O /tmp/output/k3s "${K3S_URL}/${K3S_VERSION}/k3s${suffix}"
+chmod +x /tmp/output/k3s
+`
+
+// Workload is what gets installed in the rootfs to run a workload preset in the VM.
+// The runtime side of presets (init command, sockets and readiness check) is in the vmconfig package.
+type Workload struct {
+	// Name is the name of the preset in vmconfig.Presets.
+	Name string
+	// Exec is the command the init script runs after loading the kernel modules.
+	Exec string
+	// KernelMods are loaded by the init script.
+	KernelMods []string
+	// KernelOptions are the kernel options the workload needs, used for the kernel config check.
+	KernelOptions []string
+	// Packages are installed with the package manager of the distro.
+	Packages []string
+	// MobyBinaries are the binaries taken from the moby source (see GetMoby).
+	MobyBinaries []string
+	// Binaries returns a state with any other binaries the workload needs in /usr/local/bin.
+	Binaries func() llb.State
+}
+
+// InitScriptName is the path of the init script in the rootfs, which is the init command of the preset.
+func (w Workload) InitScriptName() string {
+	return vmconfig.Presets[w.Name].InitCmd
+}
+
+// InitScript returns the init script for the workload.
+func (w Workload) InitScript() File {
+	return initScript(w.InitScriptName(), w.KernelMods, w.Exec)
+}
+
+// Workloads are the supported workloads, keyed by preset name.
+var Workloads = map[string]Workload{
+	vmconfig.PresetDockerd: {
+		Name:          vmconfig.PresetDockerd,
+		Exec:          "dockerd ${@}",
+		KernelMods:    MobyKernelMods,
+		KernelOptions: append(MobyKernelOptions, OverlayKernelOptions...),
+		MobyBinaries:  MobyBinaries,
+	},
+	vmconfig.PresetContainerd: {
+		Name:          vmconfig.PresetContainerd,
+		Exec:          "containerd ${@}",
+		KernelMods:    ContainerdKernelMods,
+		KernelOptions: OverlayKernelOptions,
+		MobyBinaries:  []string{"containerd", "containerd-shim-runc-v2", "ctr", "runc"},
+	},
+	vmconfig.PresetPodman: {
+		Name:          vmconfig.PresetPodman,
+		Exec:          "podman system service --time=0 unix:///run/podman/podman.sock",
+		KernelMods:    MobyKernelMods,
+		KernelOptions: append(MobyKernelOptions, OverlayKernelOptions...),
+		Packages:      []string{"podman"},
+	},
+	vmconfig.PresetK3s: {
+		Name:          vmconfig.PresetK3s,
+		Exec:          "k3s server --write-kubeconfig-mode=644 ${@}",
+		KernelMods:    MobyKernelMods,
+		KernelOptions: append(MobyKernelOptions, OverlayKernelOptions...),
+		Binaries:      getK3sBinaries,
+	},
+	vmconfig.PresetBuildkitd: {
+		Name:          vmconfig.PresetBuildkitd,
+		Exec:          "buildkitd ${@}",
+		KernelMods:    ContainerdKernelMods,
+		KernelOptions: OverlayKernelOptions,
+		Binaries:      getBuildkitBinaries,
+	},
+}
+
+// WorkloadNames returns the sorted names of all supported workloads.
+func WorkloadNames() []string {
+	names := make([]string, 0, len(Workloads))
+	for name := range Workloads {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetWorkload looks up a workload by preset name.
+func GetWorkload(name string) (Workload, error) {
+	w, ok := Workloads[name]
+	if !ok {
+		return Workload{}, fmt.Errorf("unsupported preset %q, must be one of: %s", name, strings.Join(WorkloadNames(), ", "))
+	}
+	return w, nil
+}
+
+func getK3sBinaries() llb.State {
+	st := llb.Image(DistroAlpine.Ref).
+		Run(
+			llb.AddEnv("K3S_URL", strings.TrimSuffix(K3sURL, "/")),
+			llb.AddEnv("K3S_VERSION", strings.ReplaceAll(K3sVersion, "+", "%2B")),
+			llb.Args([]string{"/bin/sh", "-ec", getK3s}),
+		).Root()
+	return llb.Scratch().File(llb.Copy(st, "/tmp/output/", "/usr/local/bin/", createParentsCopyOption{}, copyDirContentsOnly{}))
+}
+
+func getBuildkitBinaries() llb.State {
+	img := llb.Image(BuildkitRef)
+	st := llb.Scratch()
+	for _, bin := range []string{"buildkitd", "buildctl", "buildkit-runc"} {
+		st = st.File(llb.Copy(img, "/usr/bin/"+bin, "/usr/local/bin/"+bin, createParentsCopyOption{}))
+	}
+	return st
+}
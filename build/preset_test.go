@@ -0,0 +1,65 @@
+package build
+
+import (
+	"testing"
+
+	"github.com/cpuguy83/qemu-micro-env/build/vmconfig"
+)
+
+func TestWorkloadsMatchPresets(t *testing.T) {
+	for name, p := range vmconfig.Presets {
+		w, err := GetWorkload(name)
+		if err != nil {
+			t.Errorf("no workload for preset %s: %v", name, err)
+			continue
+		}
+		if w.Name != name || w.InitScriptName() != p.InitCmd {
+			t.Errorf("%s: workload %s with init script %s does not match the preset", name, w.Name, w.InitScriptName())
+		}
+		if len(w.MobyBinaries) == 0 && w.Binaries == nil && len(w.Packages) == 0 {
+			t.Errorf("%s: workload does not install anything", name)
+		}
+	}
+	if len(Workloads) != len(vmconfig.Presets) {
+		t.Errorf("expected %d workloads, got %d", len(vmconfig.Presets), len(Workloads))
+	}
+}
+
+func TestKernelRequirementsFor(t *testing.T) {
+	opts := KernelRequirementsFor(vmconfig.Presets[vmconfig.PresetDockerd].InitCmd, 2)
+	if !contains(opts, "CONFIG_BRIDGE") || !contains(opts, "CONFIG_OVERLAY_FS") {
+		t.Errorf("expected dockerd requirements, got %v", opts)
+	}
+
+	opts = KernelRequirementsFor(vmconfig.Presets[vmconfig.PresetContainerd].InitCmd, 2)
+	if contains(opts, "CONFIG_BRIDGE") || !contains(opts, "CONFIG_OVERLAY_FS") {
+		t.Errorf("expected containerd requirements, got %v", opts)
+	}
+
+	opts = KernelRequirementsFor("/bin/sh", 2)
+	if contains(opts, "CONFIG_OVERLAY_FS") || contains(opts, "CONFIG_VIRTIO_FS") {
+		t.Errorf("expected only cgroup requirements for a custom init command, got %v", opts)
+	}
+
+	opts = KernelRequirementsFor("/bin/sh", 2, vmconfig.MountTypeVirtiofs, vmconfig.MountTypeVirtiofs)
+	if !contains(opts, "CONFIG_FUSE_FS") || !contains(opts, "CONFIG_VIRTIO_FS") || contains(opts, "CONFIG_9P_FS") {
+		t.Errorf("expected virtiofs requirements, got %v", opts)
+	}
+	if len(opts) != len(CgroupKernelOptions(2))+2 {
+		t.Errorf("expected requirements of a mount type once, got %v", opts)
+	}
+
+	opts = KernelRequirementsFor("/bin/sh", 2, vmconfig.MountType9p)
+	if !contains(opts, "CONFIG_9P_FS") || contains(opts, "CONFIG_VIRTIO_FS") {
+		t.Errorf("expected 9p requirements, got %v", opts)
+	}
+}
+
+func contains(ls []string, s string) bool {
+	for _, v := range ls {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
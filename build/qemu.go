@@ -1,39 +1,207 @@
 package build
 
 import (
+	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/moby/buildkit/client/llb"
 )
 
-func QcowFrom(rootfs llb.State, size int64) File {
-	sizeStr := strconv.FormatInt(size, 10)
+const (
+	FilesystemExt4     = "ext4"
+	FilesystemXfs      = "xfs"
+	FilesystemBtrfs    = "btrfs"
+	FilesystemSquashfs = "squashfs"
+	FilesystemErofs    = "erofs"
+)
+
+// RootFilesystems are the filesystems that can be used for a read-write root disk.
+var RootFilesystems = []string{FilesystemExt4, FilesystemXfs, FilesystemBtrfs}
+
+// ReadOnlyRootFilesystems are the filesystems that can be used for a read-only root disk.
+var ReadOnlyRootFilesystems = []string{FilesystemSquashfs, FilesystemErofs}
+
+// QcowInfoPath is where information about the created disk image is stored.
+// The file contains key=value lines with the filesystem (fs), whether the disk is read-only or read-write (mode),
+// the size of the disk (size), the size of the qcow file (qcow_size), and the number of inodes used (inodes).
+const QcowInfoPath = "/tmp/rootfs.info"
+
+// RootOverlayDir is created in read-only root disks so the VM init has a place to setup the writable overlay.
+const RootOverlayDir = "/.overlay"
+
+// DiskConfig configures how the root disk image is created.
+type DiskConfig struct {
+	// Filesystem to format the disk with, see RootFilesystems.
+	// Defaults to ext4.
+	Filesystem string
+	// Size of the disk in bytes.
+	// When 0 the size is computed from the rootfs content plus Headroom.
+	// This is ignored for read-only disks, which are always sized to fit the content.
+	Size     int64
+	Headroom int64
+	// ReadOnly creates a compressed read-only disk.
+	// The VM init sets up a writable overlay on top of it.
+	ReadOnly bool
+}
+
+func (c DiskConfig) filesystem() string {
+	if c.Filesystem != "" {
+		return c.Filesystem
+	}
+	if c.ReadOnly {
+		return FilesystemSquashfs
+	}
+	return FilesystemExt4
+}
+
+// Validate checks that the disk config is usable.
+func (c DiskConfig) Validate() error {
+	supported := RootFilesystems
+	mode := "read-write"
+	if c.ReadOnly {
+		supported = ReadOnlyRootFilesystems
+		mode = "read-only"
+	}
+
+	fs := c.filesystem()
+	for _, s := range supported {
+		if s == fs {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported filesystem %q for %s root, must be one of: %s", fs, mode, strings.Join(supported, ", "))
+}
+
+func QcowFrom(rootfs llb.State, cfg DiskConfig) File {
+	fs := cfg.filesystem()
+	mode := "rw"
+	if cfg.ReadOnly {
+		mode = "ro"
+	}
+
+	base := QemuBase()
+	if fs == FilesystemXfs {
+		base = XfsBase()
+	}
+
 	rootfsMount := llb.AddMount("/tmp/rootfs", rootfs)
-	return NewFile(QemuBase().
+	return NewFile(base.
 		Run(rootfsMount,
-			llb.Args([]string{"/bin/sh", "-ec", ` 
-			truncate -s` + sizeStr + ` /tmp/rootfs.img
-			mkfs.ext4 -d /tmp/rootfs /tmp/rootfs.img
+			llb.AddEnv("FS", fs),
+			llb.AddEnv("MODE", mode),
+			llb.AddEnv("SIZE", strconv.FormatInt(cfg.Size, 10)),
+			llb.AddEnv("HEADROOM", strconv.FormatInt(cfg.Headroom, 10)),
+			llb.Args([]string{"/bin/bash", "-ec", `
+			inodes=$(find /tmp/rootfs -xdev | wc -l)
+
+			size="${SIZE}"
+			mkfs_opts=""
+			if [ "${size}" = "0" ]; then
+				used=$(du -sx --block-size=1 /tmp/rootfs | cut -f1)
+				size=$(( used + used / 5 + 64 * 1024 * 1024 + HEADROOM ))
+				# Smallest size supported by all the filesystems
+				if [ "${size}" -lt $(( 512 * 1024 * 1024 )) ]; then
+					size=$(( 512 * 1024 * 1024 ))
+				fi
+				# A tightly sized ext4 can otherwise run out of inodes before it runs out of space
+				mkfs_opts="-i 8192"
+			fi
+
+			if [ "${MODE}" = "ro" ]; then
+				mkdir -p /tmp/rootfs` + RootOverlayDir + `
+			else
+				truncate -s ${size} /tmp/rootfs.img
+			fi
+			case "${FS}" in
+				ext4)
+					mkfs.ext4 ${mkfs_opts} -d /tmp/rootfs /tmp/rootfs.img
+					;;
+				btrfs)
+					mkfs.btrfs --rootdir /tmp/rootfs /tmp/rootfs.img
+					;;
+				xfs)
+					mkfs.xfs ` + xfsFeatureOpts + ` -p /tmp/rootfs /tmp/rootfs.img
+					;;
+				squashfs)
+					mksquashfs /tmp/rootfs /tmp/rootfs.img -noappend -no-progress
+					;;
+				erofs)
+					mkfs.erofs -zlz4hc /tmp/rootfs.img /tmp/rootfs
+					;;
+			esac
+			size=$(stat -c %s /tmp/rootfs.img)
 			qemu-img convert /tmp/rootfs.img -O qcow2 /tmp/rootfs.qcow2
 			rm /tmp/rootfs.img
+
+			{
+				echo "fs=${FS}"
+				echo "mode=${MODE}"
+				echo "size=${size}"
+				echo "qcow_size=$(stat -c %s /tmp/rootfs.qcow2)"
+				echo "inodes=${inodes}"
+			} > ` + QcowInfoPath + `
 		`})).Root(),
 		"/tmp/rootfs.qcow2")
 }
 
+// QcowInfo returns the info file (see QcowInfoPath) for a disk image created with QcowFrom.
+func QcowInfo(qcow File) File {
+	return NewFile(qcow.st, QcowInfoPath)
+}
+
+// KernelDiskPath is the path the kernel disk image is stored at in the VM image.
+const KernelDiskPath = "/boot/kernel.qcow2"
+
+// KernelDiskFrom creates a (small) qcow image with the content of the passed in state.
+// The image is sized to fit the content.
+// /boot/vmlinuz and /boot/config are renamed to include the kernel version, as is the convention on most distros.
+func KernelDiskFrom(st llb.State) File {
+	return NewFile(QemuBase().
+		Run(
+			llb.AddMount("/tmp/kernel", st),
+			llb.Args([]string{"/bin/sh", "-ec", `
+			cd /tmp/kernel
+			ver=""
+			if [ -d lib/modules ]; then
+				ver="$(ls lib/modules | head -n1)"
+			fi
+			if [ -z "${ver}" ] && [ -f boot/config ]; then
+				ver="$(sed -n 's/^# Linux\/[^ ]* \([^ ]*\) Kernel Configuration$/\1/p' boot/config)"
+			fi
+			if [ -n "${ver}" ]; then
+				[ ! -f boot/vmlinuz ] || mv boot/vmlinuz "boot/vmlinuz-${ver}"
+				[ ! -f boot/config ] || mv boot/config "boot/config-${ver}"
+			fi
+
+			size=$(du -sk /tmp/kernel | cut -f1)
+			truncate -s $(( (size + size / 5 + 16384) * 1024 )) /tmp/kernel.img
+			mkfs.ext4 -q -d /tmp/kernel /tmp/kernel.img
+			qemu-img convert /tmp/kernel.img -O qcow2 /tmp/kernel.qcow2
+			rm /tmp/kernel.img
+		`})).Root(),
+		"/tmp/kernel.qcow2").WithTarget(KernelDiskPath)
+}
+
+// RootfsDiffPath is the path of the overlay disk, backed by the root disk, which the VM boots from.
+const RootfsDiffPath = "/tmp/rootfs-diff.qcow2"
+
+// QcowDiff creates an empty qcow overlay which uses the passed in qcow as its backing file.
+// The backing file is referenced by the target path of the passed in qcow, which is where it is expected to be at runtime.
 func QcowDiff(qcow File) File {
 	return NewFile(
 		QemuBase().
 			Run(
-				llb.AddMount("/tmp/rootfs", qcow.State(), llb.SourcePath(qcow.Path())),
+				llb.AddMount(qcow.Target(), qcow.State(), llb.SourcePath(qcow.Target()), llb.Readonly),
 				llb.Args([]string{
 					"/usr/bin/qemu-img",
 					"create",
 					"-f", "qcow2",
-					"-b", "/tmp/rootfs.qcow2",
+					"-b", qcow.Target(),
 					"-F", "qcow2",
-					"/tmp/rootfs-diff.qcow2",
+					RootfsDiffPath,
 				}),
-			).Root(), "/tmp/rootfs-diff.qcow2")
+			).Root(), RootfsDiffPath)
 }
 
 func QemuBase() llb.State {
@@ -47,5 +215,44 @@ func QemuBase() llb.State {
 				openssh-client \
 				socat \
 				e2fsprogs \
+				xfsprogs \
+				btrfs-progs \
+				squashfs-tools \
+				erofs-utils \
+				genisoimage \
+				iptables \
 		`})).Root()
 }
+
+// XfsRef is the image xfs disks are created with.
+// jammy's mkfs.xfs can only populate a filesystem with a protofile, which does not support all file names,
+// a directory can be used since xfsprogs 6.16.
+var XfsRef = "alpine:3.23"
+
+// xfsFeatureOpts are passed to mkfs.xfs to turn off the features newer xfsprogs enable by default which the
+// 5.15 kernel (jammy's) cannot mount: large extent counts (5.19), file exchange (6.10), parent pointers (6.10)
+// and the metadata directory tree (6.13).
+// The features kept (bigtime, inobtcount, reflink, ...) are all supported by 5.15.
+const xfsFeatureOpts = "-i nrext64=0,exchange=0 -n parent=0 -m metadir=0"
+
+// XfsBase has the tools needed to create xfs disks with QcowFrom.
+func XfsBase() llb.State {
+	return llb.Image(XfsRef).
+		Run(llb.Shlex("apk add --no-cache bash coreutils findutils xfsprogs qemu-img")).Root()
+}
+
+// PasstRef is the image the passt binary is taken from.
+// passt is not packaged for jammy, the bookworm build only needs a glibc that jammy has.
+var PasstRef = DistroDebian.Ref
+
+// PasstPath is where the passt binary is stored in the VM image.
+const PasstPath = "/usr/bin/passt"
+
+// Passt returns the passt binary used for passt networking.
+func Passt() File {
+	return NewFile(llb.Image(PasstRef).
+		Run(llb.Args([]string{
+			"/bin/sh", "-c",
+			"apt-get update && apt-get install -y passt",
+		})).Root(), PasstPath)
+}
@@ -1,19 +1,153 @@
 package build
 
 import (
+	"fmt"
+	"sort"
+	"strings"
+
 	"github.com/moby/buildkit/client/llb"
 )
 
 var JammyRef = "ubuntu:jammy"
 
+// PackageManager is the package manager used by a distro.
+type PackageManager string
+
+const (
+	Apt PackageManager = "apt"
+	Apk PackageManager = "apk"
+	Dnf PackageManager = "dnf"
+)
+
+// InstallCmd returns the shell command used to install the passed in packages.
+// Packages can be pinned to a version with name=version.
+func (pm PackageManager) InstallCmd(pkgs ...string) string {
+	switch pm {
+	case Apk:
+		return "apk add --no-cache " + strings.Join(pkgs, " ")
+	case Dnf:
+		// dnf uses name-version instead of name=version
+		converted := make([]string, 0, len(pkgs))
+		for _, p := range pkgs {
+			converted = append(converted, strings.Replace(p, "=", "-", 1))
+		}
+		return "dnf install -y " + strings.Join(converted, " ") + " && dnf clean all"
+	default:
+		return "apt-get update && apt-get install -y " + strings.Join(pkgs, " ")
+	}
+}
+
+// Distro describes how to build a rootfs for the VM from a linux distribution.
+type Distro struct {
+	Name           string
+	Ref            string
+	PackageManager PackageManager
+	// Packages are the packages needed by the VM init (sshd, kmod, iptables, mkfs.ext4).
+	Packages []string
+	// Setup are shell commands used to prepare the rootfs after the packages are installed.
+	Setup []string
+}
+
+var (
+	DistroJammy = Distro{
+		Name:           "jammy",
+		Ref:            JammyRef,
+		PackageManager: Apt,
+		Packages:       []string{"iptables", "ssh", "kmod"},
+		Setup:          []string{"update-alternatives --set iptables /usr/sbin/iptables-legacy"},
+	}
+	DistroDebian = Distro{
+		Name:           "debian",
+		Ref:            "debian:bookworm",
+		PackageManager: Apt,
+		Packages:       []string{"iptables", "openssh-server", "kmod"},
+		Setup:          []string{"update-alternatives --set iptables /usr/sbin/iptables-legacy"},
+	}
+	DistroAlpine = Distro{
+		Name:           "alpine",
+		Ref:            "alpine:3.18",
+		PackageManager: Apk,
+		Packages:       []string{"iptables", "openssh", "kmod", "e2fsprogs"},
+		Setup: []string{
+			// /sbin/init is a symlink to busybox, remove it so copying our init doesn't write through it.
+			"rm -f /sbin/init",
+			"ssh-keygen -A",
+			// root is locked by default, which makes sshd refuse key based logins.
+			"sed -i 's/^root:!/root:*/' /etc/shadow",
+		},
+	}
+	DistroFedora = Distro{
+		Name:           "fedora",
+		Ref:            "fedora:38",
+		PackageManager: Dnf,
+		Packages:       []string{"iptables-legacy", "openssh-server", "kmod", "e2fsprogs"},
+		Setup: []string{
+			"ssh-keygen -A",
+			"alternatives --set iptables /usr/sbin/iptables-legacy",
+		},
+	}
+	DistroAmazonLinux = Distro{
+		Name:           "amazonlinux",
+		Ref:            "amazonlinux:2023",
+		PackageManager: Dnf,
+		Packages:       []string{"iptables-legacy", "openssh-server", "kmod", "e2fsprogs"},
+		Setup: []string{
+			"ssh-keygen -A",
+			"alternatives --set iptables /usr/sbin/iptables-legacy",
+		},
+	}
+)
+
+// Distros are the supported distros, keyed by name.
+var Distros = map[string]Distro{
+	DistroJammy.Name:       DistroJammy,
+	DistroDebian.Name:      DistroDebian,
+	DistroAlpine.Name:      DistroAlpine,
+	DistroFedora.Name:      DistroFedora,
+	DistroAmazonLinux.Name: DistroAmazonLinux,
+}
+
+// DistroNames returns the sorted names of all supported distros.
+func DistroNames() []string {
+	names := make([]string, 0, len(Distros))
+	for name := range Distros {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetDistro looks up a distro by name.
+func GetDistro(name string) (Distro, error) {
+	d, ok := Distros[name]
+	if !ok {
+		return Distro{}, fmt.Errorf("unsupported distro %q, must be one of: %s", name, strings.Join(DistroNames(), ", "))
+	}
+	return d, nil
+}
+
+// Install installs the packages into the passed in state using the distro's package manager.
+func (d Distro) Install(st llb.State, pkgs ...string) llb.State {
+	if len(pkgs) == 0 {
+		return st
+	}
+	return st.Run(
+		llb.Args([]string{"/bin/sh", "-c", d.PackageManager.InstallCmd(pkgs...)}),
+		llb.AddEnv("DEBIAN_FRONTEND", "noninteractive"),
+	).Root()
+}
+
+// Rootfs returns a rootfs for the distro with everything the VM init needs.
+func (d Distro) Rootfs() llb.State {
+	st := d.Install(llb.Image(d.Ref), d.Packages...)
+	for _, cmd := range d.Setup {
+		st = st.Run(llb.Args([]string{"/bin/sh", "-c", cmd})).Root()
+	}
+	return st
+}
+
 func JammyRootfs() llb.State {
-	return llb.Image(JammyRef).
-		Run(llb.Args([]string{
-			"/bin/sh", "-c",
-			"apt-get update && apt-get install -y iptables ssh kmod",
-		}),
-			llb.AddEnv("DEBIAN_FRONTEND", "noninteractive"),
-		).
-		Run(llb.Args([]string{"/usr/bin/update-alternatives", "--set", "iptables", "/usr/sbin/iptables-legacy"})).
-		Root()
+	d := DistroJammy
+	d.Ref = JammyRef
+	return d.Rootfs()
 }
@@ -0,0 +1,22 @@
+package build
+
+import "testing"
+
+func TestPackageManagerInstallCmd(t *testing.T) {
+	pkgs := []string{"strace", "criu=3.17"}
+
+	cases := map[PackageManager]string{
+		Apt: "apt-get update && apt-get install -y strace criu=3.17",
+		Apk: "apk add --no-cache strace criu=3.17",
+		Dnf: "dnf install -y strace criu-3.17 && dnf clean all",
+	}
+	for pm, expected := range cases {
+		if cmd := pm.InstallCmd(pkgs...); cmd != expected {
+			t.Errorf("%s: expected %q, got %q", pm, expected, cmd)
+		}
+	}
+
+	if pkgs[1] != "criu=3.17" {
+		t.Errorf("packages should not be modified: %v", pkgs)
+	}
+}
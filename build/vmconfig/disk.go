@@ -0,0 +1,112 @@
+package vmconfig
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// VolumesDir is the directory, relative to the state dir, where data disks are stored.
+const VolumesDir = "volumes"
+
+const (
+	// CloudImageScheme is the --disk scheme for booting a vendor cloud image.
+	CloudImageScheme = "cloud-image"
+	// CloudImagePath is where the runner mounts the cloud image in the container.
+	CloudImagePath = "/tmp/cloud-image.qcow2"
+)
+
+// DockerdBinPath is where the runner mounts the --dockerd-bin path in the container.
+const DockerdBinPath = "/tmp/dockerd-bin"
+
+// ParseDiskSpec parses a --disk spec in the form of <scheme>://<path>.
+// Only cloud-image:// is currently supported.
+func ParseDiskSpec(s string) (scheme, p string, err error) {
+	scheme, p, ok := strings.Cut(s, "://")
+	if !ok || p == "" {
+		return "", "", fmt.Errorf("invalid disk spec, must be <scheme>://<path>: %s", s)
+	}
+	if scheme != CloudImageScheme {
+		return "", "", fmt.Errorf("unsupported disk scheme %q, must be %s", scheme, CloudImageScheme)
+	}
+	return scheme, p, nil
+}
+
+// PersistedRootDisk is the file name, relative to the state dir, of the root disk overlay used with --persist.
+const PersistedRootDisk = "rootfs.qcow2"
+
+// DataDiskSerialPrefix is prepended to the data disk name to get the serial of the disk in the VM.
+const DataDiskSerialPrefix = "data-"
+
+// virtio-blk serials are limited to 20 characters, which includes the serial prefix.
+var dataDiskNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]{0,14}$`)
+
+// DataDisk is a disk that is persisted in the state dir across runs and mounted in the VM.
+type DataDisk struct {
+	Name string
+	// Size is only used when creating the disk.
+	Size  string
+	Mount string
+}
+
+// Serial is the serial of the disk as seen by the VM.
+func (d DataDisk) Serial() string {
+	return DataDiskSerialPrefix + d.Name
+}
+
+func (d DataDisk) String() string {
+	return "name=" + d.Name + ",size=" + d.Size + ",mount=" + d.Mount
+}
+
+// ParseDataDisk parses a data disk spec in the form of name=<name>,size=<size>,mount=<path>.
+func ParseDataDisk(s string) (DataDisk, error) {
+	var d DataDisk
+	for _, field := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(field, "=")
+		if !ok {
+			return d, fmt.Errorf("invalid data disk field %q: expected key=value", field)
+		}
+		switch k {
+		case "name":
+			d.Name = v
+		case "size":
+			d.Size = v
+		case "mount":
+			d.Mount = v
+		default:
+			return d, fmt.Errorf("unknown data disk field %q", k)
+		}
+	}
+
+	if !dataDiskNameRegexp.MatchString(d.Name) {
+		return d, fmt.Errorf("invalid data disk name %q: must be 1-15 alphanumeric, '-', or '_' characters", d.Name)
+	}
+	if d.Size == "" {
+		return d, fmt.Errorf("data disk %q is missing a size", d.Name)
+	}
+	if !path.IsAbs(d.Mount) {
+		return d, fmt.Errorf("data disk %q must have an absolute mount path", d.Name)
+	}
+	return d, nil
+}
+
+type dataDiskListFlag []DataDisk
+
+func (f *dataDiskListFlag) String() string {
+	return fmt.Sprint(*f)
+}
+
+func (f *dataDiskListFlag) Set(s string) error {
+	d, err := ParseDataDisk(s)
+	if err != nil {
+		return err
+	}
+	for _, existing := range *f {
+		if existing.Name == d.Name {
+			return fmt.Errorf("duplicate data disk name %q", d.Name)
+		}
+	}
+	*f = append(*f, d)
+	return nil
+}
@@ -0,0 +1,38 @@
+package vmconfig
+
+import "testing"
+
+func TestParseDataDisk(t *testing.T) {
+	d, err := ParseDataDisk("name=docker,size=20G,mount=/var/lib/docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Name != "docker" || d.Size != "20G" || d.Mount != "/var/lib/docker" {
+		t.Fatalf("unexpected data disk: %+v", d)
+	}
+	if d.Serial() != "data-docker" {
+		t.Fatalf("unexpected serial: %s", d.Serial())
+	}
+
+	roundTrip, err := ParseDataDisk(d.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if roundTrip != d {
+		t.Fatalf("expected %+v, got %+v", d, roundTrip)
+	}
+
+	for _, s := range []string{
+		"",
+		"name=docker,size=20G",
+		"name=docker,mount=/var/lib/docker",
+		"name=docker,size=20G,mount=var/lib/docker",
+		"name=../docker,size=20G,mount=/var/lib/docker",
+		"name=averyveryverylongname,size=20G,mount=/data",
+		"name=docker,size=20G,mount=/data,foo=bar",
+	} {
+		if _, err := ParseDataDisk(s); err == nil {
+			t.Errorf("expected error for %q", s)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package vmconfig
+
+const (
+	// KindDefaultConfig is the value of --kind when it is passed without a config file.
+	KindDefaultConfig = "default"
+	// KindConfigPath is where the runner mounts the kind config file in the container.
+	KindConfigPath = "/tmp/kind-config.yml"
+	// KindKubeconfig is the file, relative to the state dir, the kubeconfig of the kind cluster is written to.
+	KindKubeconfig = "kubeconfig"
+	// KindAPIServerPort is the port the kind API server listens on in the VM.
+	KindAPIServerPort = 6443
+)
+
+// kindFlag is a flag which can be passed as a boolean (--kind) or with a config file (--kind=<path>).
+type kindFlag string
+
+func (f *kindFlag) String() string {
+	return string(*f)
+}
+
+func (f *kindFlag) Set(s string) error {
+	switch s {
+	case "true":
+		*f = KindDefaultConfig
+	case "false":
+		*f = ""
+	default:
+		*f = kindFlag(s)
+	}
+	return nil
+}
+
+func (f *kindFlag) IsBoolFlag() bool {
+	return true
+}
@@ -0,0 +1,26 @@
+package vmconfig
+
+import (
+	"flag"
+	"testing"
+)
+
+func TestKindFlag(t *testing.T) {
+	cases := map[string]string{
+		"--kind":                KindDefaultConfig,
+		"--kind=true":           KindDefaultConfig,
+		"--kind=false":          "",
+		"--kind=./my-kind.yaml": "./my-kind.yaml",
+	}
+	for arg, expected := range cases {
+		var cfg VMConfig
+		set := flag.NewFlagSet("test", flag.ContinueOnError)
+		AddVMFlags(set, &cfg)
+		if err := set.Parse([]string{arg}); err != nil {
+			t.Fatalf("%s: %v", arg, err)
+		}
+		if string(cfg.Kind) != expected {
+			t.Errorf("%s: expected %q, got %q", arg, expected, cfg.Kind)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package vmconfig
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MountTypeVirtiofs shares a host directory with virtiofs, which is faster but needs virtiofsd and shared memory.
+	MountTypeVirtiofs = "virtiofs"
+	// MountType9p shares a host directory with virtio-9p.
+	MountType9p = "9p"
+
+	// SharedMountsDir is where the runner mounts the sources of shared mounts in the container.
+	SharedMountsDir = "/tmp/mounts"
+)
+
+// SharedMount is a host directory shared with the VM.
+type SharedMount struct {
+	Type     string
+	Source   string
+	Target   string
+	ReadOnly bool
+}
+
+// MountTag is the tag the VM uses to find a shared mount, i is the index of the mount.
+func MountTag(i int) string {
+	return "mount" + strconv.Itoa(i)
+}
+
+func (m SharedMount) String() string {
+	s := "type=" + m.Type + ",source=" + m.Source + ",target=" + m.Target
+	if m.ReadOnly {
+		s += ",ro"
+	}
+	return s
+}
+
+// ParseSharedMount parses a mount spec in the form of type=<virtiofs|9p>,source=<host path>,target=<guest path>[,ro].
+func ParseSharedMount(s string) (SharedMount, error) {
+	var m SharedMount
+	for _, field := range strings.Split(s, ",") {
+		k, v, _ := strings.Cut(field, "=")
+		switch k {
+		case "type":
+			m.Type = v
+		case "source", "src":
+			m.Source = v
+		case "target", "dst":
+			m.Target = v
+		case "ro", "readonly":
+			if v == "" {
+				m.ReadOnly = true
+				continue
+			}
+			ro, err := strconv.ParseBool(v)
+			if err != nil {
+				return m, fmt.Errorf("invalid value for %s: %w", k, err)
+			}
+			m.ReadOnly = ro
+		default:
+			return m, fmt.Errorf("unknown mount field %q", k)
+		}
+	}
+
+	switch m.Type {
+	case MountTypeVirtiofs, MountType9p:
+	default:
+		return m, fmt.Errorf("invalid mount type %q, must be %s or %s", m.Type, MountTypeVirtiofs, MountType9p)
+	}
+	if m.Source == "" {
+		return m, fmt.Errorf("mount is missing a source: %s", s)
+	}
+	if !path.IsAbs(m.Target) {
+		return m, fmt.Errorf("mount target must be an absolute path: %s", s)
+	}
+	return m, nil
+}
+
+type sharedMountListFlag []SharedMount
+
+func (f *sharedMountListFlag) String() string {
+	return fmt.Sprint(*f)
+}
+
+func (f *sharedMountListFlag) Set(s string) error {
+	m, err := ParseSharedMount(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, m)
+	return nil
+}
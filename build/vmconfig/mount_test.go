@@ -0,0 +1,39 @@
+package vmconfig
+
+import "testing"
+
+func TestParseSharedMount(t *testing.T) {
+	m, err := ParseSharedMount("type=virtiofs,source=./src,target=/src,ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := SharedMount{Type: MountTypeVirtiofs, Source: "./src", Target: "/src", ReadOnly: true}
+	if m != expected {
+		t.Fatalf("expected %+v, got %+v", expected, m)
+	}
+
+	roundTrip, err := ParseSharedMount(m.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if roundTrip != m {
+		t.Fatalf("expected %+v, got %+v", m, roundTrip)
+	}
+
+	if MountTag(0) != "mount0" || MountTag(1) == MountTag(0) {
+		t.Errorf("unexpected mount tags: %s, %s", MountTag(0), MountTag(1))
+	}
+
+	for _, s := range []string{
+		"",
+		"type=nfs,source=./src,target=/src",
+		"type=9p,target=/src",
+		"type=9p,source=./src,target=src",
+		"type=9p,source=./src,target=/src,ro=maybe",
+		"type=9p,source=./src,target=/src,foo=bar",
+	} {
+		if _, err := ParseSharedMount(s); err == nil {
+			t.Errorf("expected error for %q", s)
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cpuguy83/go-vsock"
@@ -37,18 +38,36 @@ func closeRead(c io.Closer) error {
 	return c.Close()
 }
 
-func convertPortForwards(ls []int) []string {
-	var result []string
-	for _, l := range ls {
-		result = append(result, strconv.Itoa(l))
+const (
+	// NetUser is qemu user-mode networking, ports are forwarded with hostfwd.
+	NetUser = "user"
+	// NetTap connects the VM to a bridge in the runner container with a tap device.
+	// The guest gets its address from a DHCP server on the bridge and ports are mapped to it with DNAT.
+	NetTap = "tap"
+	// NetPasst connects the VM to passt running in the runner container.
+	// passt copies the container's addresses to the guest and maps the forwarded ports to it.
+	NetPasst = "passt"
+)
+
+// NetModes are the supported networking modes.
+var NetModes = []string{NetUser, NetTap, NetPasst}
+
+// ValidateNetMode checks that the passed in networking mode is supported.
+func ValidateNetMode(mode string) error {
+	for _, m := range NetModes {
+		if m == mode {
+			return nil
+		}
 	}
-	return result
+	return fmt.Errorf("unsupported network mode %q, must be one of: %s", mode, strings.Join(NetModes, ", "))
 }
 
-func ForwardPort(localPort, remotePort int) error {
+// ForwardPort proxies connections to localPort to remotePort on the loopback interface.
+// Closing the returned listener stops accepting new connections.
+func ForwardPort(localPort, remotePort int) (io.Closer, error) {
 	l, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:"+strconv.Itoa(localPort)))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	go func() {
@@ -87,7 +106,78 @@ func ForwardPort(localPort, remotePort int) error {
 		}
 	}()
 
-	return nil
+	return l, nil
+}
+
+// udpSessionTimeout is how long a UDP client mapping is kept without any replies.
+const udpSessionTimeout = 2 * time.Minute
+
+// ForwardUDPPort relays datagrams received on localPort to remotePort on the loopback interface.
+// Every client gets its own socket to the remote so replies go back to the client that sent the request.
+// Closing the returned socket stops the relay.
+func ForwardUDPPort(localPort, remotePort int) (io.Closer, error) {
+	l, err := net.ListenPacket("udp", "0.0.0.0:"+strconv.Itoa(localPort))
+	if err != nil {
+		return nil, err
+	}
+
+	remoteAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: remotePort}
+
+	go func() {
+		defer l.Close()
+
+		var mu sync.Mutex
+		sessions := make(map[string]*net.UDPConn)
+
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := l.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			mu.Lock()
+			remote, ok := sessions[addr.String()]
+			if !ok {
+				remote, err = net.DialUDP("udp", nil, remoteAddr)
+				if err != nil {
+					mu.Unlock()
+					logrus.WithError(err).Error("dial failed")
+					continue
+				}
+				sessions[addr.String()] = remote
+
+				go func(addr net.Addr, remote *net.UDPConn) {
+					defer func() {
+						mu.Lock()
+						delete(sessions, addr.String())
+						mu.Unlock()
+						remote.Close()
+					}()
+
+					buf := make([]byte, 65535)
+					for {
+						remote.SetReadDeadline(time.Now().Add(udpSessionTimeout))
+						n, err := remote.Read(buf)
+						if err != nil {
+							return
+						}
+						if _, err := l.WriteTo(buf[:n], addr); err != nil {
+							logrus.WithError(err).Error("write failed")
+							return
+						}
+					}
+				}(addr, remote)
+			}
+			mu.Unlock()
+
+			if _, err := remote.Write(buf[:n]); err != nil {
+				logrus.WithError(err).Error("write failed")
+			}
+		}
+	}()
+
+	return l, nil
 }
 
 func DoVsock(cid uint32, uid, gid int) error {
@@ -146,7 +236,7 @@ func DoVsock(cid uint32, uid, gid int) error {
 	return nil
 }
 
-func GetLocalPorts(forwards []int) ([]int, error) {
+func GetLocalPorts(forwards []PortForward) ([]int, error) {
 	out := make([]int, 0, len(forwards))
 	data, err := os.ReadFile("/proc/sys/net/ipv4/ip_local_port_range")
 	if err != nil {
@@ -164,10 +254,10 @@ func GetLocalPorts(forwards []int) ([]int, error) {
 	return out, nil
 }
 
-func PortForwardsToQemuFlag(local, forwards []int) string {
+func PortForwardsToQemuFlag(local []int, forwards []PortForward) string {
 	var out []string
 	for i, f := range forwards {
-		out = append(out, fmt.Sprintf("hostfwd=tcp::%d-:%d", local[i], f))
+		out = append(out, fmt.Sprintf("hostfwd=%s::%d-:%d", f.Proto, local[i], f.GuestPort))
 	}
 	return strings.Join(out, ",")
 }
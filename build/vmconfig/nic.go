@@ -0,0 +1,186 @@
+package vmconfig
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// NIC is a network interface of the VM.
+// Every NIC is on its own network, only the first one gets the default route and the forwarded ports.
+type NIC struct {
+	// Subnet is the IPv4 subnet of the network, the VM gets an address in it with DHCP.
+	// Defaults to 192.168.<76+i>.0/24 for the NIC at index i.
+	Subnet string
+	// IPv6 enables IPv6 on the network, the VM configures an address in IPv6Prefix with SLAAC.
+	IPv6 bool
+	// IPv6Prefix is the IPv6 prefix of the network.
+	// Defaults to fd00:<76+i>::/64 for the NIC at index i.
+	IPv6Prefix string
+	// MAC is the MAC address of the NIC.
+	// Defaults to 52:54:00:12:34:<56+i> for the NIC at index i.
+	MAC string
+}
+
+func (n NIC) String() string {
+	var fields []string
+	if n.Subnet != "" {
+		fields = append(fields, "subnet="+n.Subnet)
+	}
+	if n.IPv6 {
+		fields = append(fields, "ipv6")
+	}
+	if n.IPv6Prefix != "" {
+		fields = append(fields, "ipv6-prefix="+n.IPv6Prefix)
+	}
+	if n.MAC != "" {
+		fields = append(fields, "mac="+n.MAC)
+	}
+	return strings.Join(fields, ",")
+}
+
+// withDefaults fills in the unset fields for the NIC at index i.
+func (n NIC) withDefaults(i int) NIC {
+	if n.Subnet == "" {
+		n.Subnet = fmt.Sprintf("192.168.%d.0/24", 76+i)
+	}
+	if n.IPv6Prefix == "" {
+		n.IPv6Prefix = fmt.Sprintf("fd00:%d::/64", 76+i)
+	}
+	if n.MAC == "" {
+		n.MAC = fmt.Sprintf("52:54:00:12:34:%02x", 0x56+i)
+	}
+	return n
+}
+
+// Interfaces returns the NICs of the VM with the defaults filled in.
+// There is always at least one NIC.
+func (c VMConfig) Interfaces() []NIC {
+	nics := c.NICs
+	if len(nics) == 0 {
+		nics = []NIC{{}}
+	}
+	out := make([]NIC, 0, len(nics))
+	for i, n := range nics {
+		out = append(out, n.withDefaults(i))
+	}
+	return out
+}
+
+// ID is the qemu netdev id of the NIC at index i.
+func (n NIC) ID(i int) string {
+	return "net" + strconv.Itoa(i)
+}
+
+// SubnetIP returns the address at the passed in offset in the IPv4 subnet of the NIC.
+func (n NIC) SubnetIP(offset int) (net.IP, *net.IPNet, error) {
+	_, subnet, err := net.ParseCIDR(n.Subnet)
+	if err != nil {
+		return nil, nil, err
+	}
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(subnet.IP.To4())+uint32(offset))
+	if !subnet.Contains(ip) {
+		return nil, nil, fmt.Errorf("subnet %s is too small", n.Subnet)
+	}
+	return ip, subnet, nil
+}
+
+// ParseNIC parses a NIC spec in the form of [subnet=<cidr>][,ipv6][,ipv6-prefix=<cidr>][,mac=<mac>].
+// Setting an IPv6 prefix enables IPv6.
+func ParseNIC(s string) (NIC, error) {
+	var n NIC
+	if s == "" {
+		return n, nil
+	}
+	for _, field := range strings.Split(s, ",") {
+		k, v, _ := strings.Cut(field, "=")
+		switch k {
+		case "subnet":
+			ip, subnet, err := net.ParseCIDR(v)
+			if err != nil {
+				return n, fmt.Errorf("invalid subnet: %w", err)
+			}
+			if ip.To4() == nil {
+				return n, fmt.Errorf("subnet must be an IPv4 subnet: %s", v)
+			}
+			if ones, _ := subnet.Mask.Size(); ones > 28 {
+				return n, fmt.Errorf("subnet must be at least a /28: %s", v)
+			}
+			n.Subnet = v
+		case "ipv6":
+			if v == "" {
+				n.IPv6 = true
+				continue
+			}
+			on, err := strconv.ParseBool(v)
+			if err != nil {
+				return n, fmt.Errorf("invalid value for %s: %w", k, err)
+			}
+			n.IPv6 = on
+		case "ipv6-prefix":
+			ip, _, err := net.ParseCIDR(v)
+			if err != nil {
+				return n, fmt.Errorf("invalid ipv6 prefix: %w", err)
+			}
+			if ip.To4() != nil {
+				return n, fmt.Errorf("ipv6 prefix must be an IPv6 prefix: %s", v)
+			}
+			n.IPv6Prefix = v
+			n.IPv6 = true
+		case "mac":
+			hw, err := net.ParseMAC(v)
+			if err != nil {
+				return n, fmt.Errorf("invalid mac: %w", err)
+			}
+			if len(hw) != 6 {
+				return n, fmt.Errorf("mac must be a 48-bit address: %s", v)
+			}
+			// Other formats (uppercase, dashes) are normalized so the MAC compares equal to the one the guest reports.
+			n.MAC = hw.String()
+		default:
+			return n, fmt.Errorf("unknown nic field %q", k)
+		}
+	}
+	return n, nil
+}
+
+// ValidateNICs checks that the NICs can be set up with the passed in networking mode.
+func ValidateNICs(mode string, nics []NIC) error {
+	switch mode {
+	case NetTap:
+		for _, n := range nics {
+			if n.IPv6 {
+				return fmt.Errorf("ipv6 is not supported with --net=%s, use --net=%s or --net=%s", NetTap, NetUser, NetPasst)
+			}
+		}
+	case NetPasst:
+		// passt copies the addresses of the container, which always includes IPv6 when the container has it.
+		if len(nics) > 1 {
+			return fmt.Errorf("multiple nics are not supported with --net=%s", NetPasst)
+		}
+		for _, n := range nics {
+			if n.Subnet != "" || n.IPv6Prefix != "" {
+				return fmt.Errorf("subnets are not supported with --net=%s, the VM gets the addresses of the runner container", NetPasst)
+			}
+		}
+	}
+	return nil
+}
+
+type nicListFlag []NIC
+
+func (f *nicListFlag) String() string {
+	return fmt.Sprint(*f)
+}
+
+func (f *nicListFlag) Set(s string) error {
+	n, err := ParseNIC(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, n)
+	return nil
+}
@@ -0,0 +1,68 @@
+package vmconfig
+
+import "testing"
+
+func TestParseNIC(t *testing.T) {
+	n, err := ParseNIC("subnet=10.10.0.0/24,ipv6-prefix=fd00:10::/64,mac=52:54:00:00:00:01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := NIC{Subnet: "10.10.0.0/24", IPv6: true, IPv6Prefix: "fd00:10::/64", MAC: "52:54:00:00:00:01"}
+	if n != expected {
+		t.Fatalf("expected %+v, got %+v", expected, n)
+	}
+
+	roundTrip, err := ParseNIC(n.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if roundTrip != n {
+		t.Fatalf("expected %+v, got %+v", n, roundTrip)
+	}
+
+	for _, mac := range []string{"52:54:00:AB:CD:EF", "52-54-00-ab-cd-ef"} {
+		n, err := ParseNIC("mac=" + mac)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.MAC != "52:54:00:ab:cd:ef" {
+			t.Errorf("expected mac %s to be normalized, got %s", mac, n.MAC)
+		}
+	}
+
+	ip, _, err := n.SubnetIP(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "10.10.0.2" {
+		t.Fatalf("unexpected subnet ip: %s", ip)
+	}
+
+	cfg := VMConfig{NICs: []NIC{{}, {IPv6: true}}}
+	nics := cfg.Interfaces()
+	if nics[0].Subnet != "192.168.76.0/24" || nics[1].Subnet != "192.168.77.0/24" || nics[1].MAC != "52:54:00:12:34:57" || !nics[1].IPv6 {
+		t.Fatalf("unexpected defaults: %+v", nics)
+	}
+
+	for _, s := range []string{
+		"subnet=10.10.0.0",
+		"subnet=fd00::/64",
+		"subnet=10.10.0.0/30",
+		"ipv6-prefix=10.10.0.0/24",
+		"ipv6=maybe",
+		"mac=nope",
+		"mac=00:00:00:00:fe:80:00:00:00:00:00:00:02:00:5e:10:00:00:00:01",
+		"foo=bar",
+	} {
+		if _, err := ParseNIC(s); err == nil {
+			t.Errorf("expected error for %q", s)
+		}
+	}
+
+	if err := ValidateNICs(NetPasst, []NIC{{}, {}}); err == nil {
+		t.Error("expected error for multiple nics with passt")
+	}
+	if err := ValidateNICs(NetTap, []NIC{{IPv6: true}}); err == nil {
+		t.Error("expected error for ipv6 with tap")
+	}
+}
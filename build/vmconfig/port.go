@@ -0,0 +1,134 @@
+package vmconfig
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	ProtoTCP = "tcp"
+	ProtoUDP = "udp"
+)
+
+// PortForward forwards a port on the host to a port in the VM.
+// The runner container exposes the guest port, which the entrypoint forwards to the VM.
+type PortForward struct {
+	// HostIP is the host address the port is published on, all addresses when empty.
+	HostIP string
+	// HostPort is the port on the host, docker picks a random port when 0.
+	HostPort int
+	// GuestPort is the port in the VM.
+	GuestPort int
+	// Proto is the protocol of the port (tcp or udp).
+	Proto string
+}
+
+func (p PortForward) String() string {
+	var s string
+	if p.HostIP != "" {
+		s = net.JoinHostPort(p.HostIP, strconv.Itoa(p.HostPort)) + ":"
+	} else if p.HostPort != 0 {
+		s = strconv.Itoa(p.HostPort) + ":"
+	}
+	return s + strconv.Itoa(p.GuestPort) + "/" + p.Proto
+}
+
+// ContainerPort is the port exposed by the runner container, in docker's <port>/<proto> format.
+func (p PortForward) ContainerPort() string {
+	return strconv.Itoa(p.GuestPort) + "/" + p.Proto
+}
+
+// ParsePortForward parses a port forward spec in the form of [[hostip:]hostport:]guestport[/tcp|/udp].
+// IPv6 host addresses must be in brackets, e.g. [::1]:8080:80.
+func ParsePortForward(s string) (PortForward, error) {
+	p := PortForward{Proto: ProtoTCP}
+
+	spec, proto, ok := strings.Cut(s, "/")
+	if ok {
+		switch proto {
+		case ProtoTCP, ProtoUDP:
+			p.Proto = proto
+		default:
+			return p, fmt.Errorf("invalid protocol %q in port forward %q, must be %s or %s", proto, s, ProtoTCP, ProtoUDP)
+		}
+	}
+
+	host, guest := "", spec
+	i := strings.LastIndex(spec, ":")
+	if i >= 0 {
+		host, guest = spec[:i], spec[i+1:]
+	}
+
+	var err error
+	p.GuestPort, err = parsePort(guest)
+	if err != nil {
+		return p, fmt.Errorf("invalid guest port in port forward %q: %w", s, err)
+	}
+
+	if i < 0 {
+		return p, nil
+	}
+
+	hostPort := host
+	if i := strings.LastIndex(host, ":"); i >= 0 {
+		p.HostIP = strings.TrimSuffix(strings.TrimPrefix(host[:i], "["), "]")
+		hostPort = host[i+1:]
+		if net.ParseIP(p.HostIP) == nil {
+			return p, fmt.Errorf("invalid host address %q in port forward %q", p.HostIP, s)
+		}
+	}
+	p.HostPort, err = parsePort(hostPort)
+	if err != nil {
+		return p, fmt.Errorf("invalid host port in port forward %q: %w", s, err)
+	}
+	return p, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if port < 1 || port > 65535 {
+		return 0, fmt.Errorf("port out of range: %d", port)
+	}
+	return port, nil
+}
+
+// GuestPorts returns the unique guest ports of the port forwards, in order.
+// Multiple host ports can be published for the same guest port, but it only needs to be forwarded to the VM once.
+func GuestPorts(forwards []PortForward) []PortForward {
+	var out []PortForward
+	seen := make(map[string]bool, len(forwards))
+	for _, f := range forwards {
+		if seen[f.ContainerPort()] {
+			continue
+		}
+		seen[f.ContainerPort()] = true
+		out = append(out, PortForward{GuestPort: f.GuestPort, Proto: f.Proto})
+	}
+	return out
+}
+
+type portForwardListFlag []PortForward
+
+func (f *portForwardListFlag) String() string {
+	var ls []string
+	for _, p := range *f {
+		ls = append(ls, p.String())
+	}
+	return strings.Join(ls, ",")
+}
+
+func (f *portForwardListFlag) Set(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		p, err := ParsePortForward(v)
+		if err != nil {
+			return err
+		}
+		*f = append(*f, p)
+	}
+	return nil
+}
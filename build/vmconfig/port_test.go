@@ -0,0 +1,65 @@
+package vmconfig
+
+import "testing"
+
+func TestParsePortForward(t *testing.T) {
+	for s, expected := range map[string]PortForward{
+		"80":                    {GuestPort: 80, Proto: ProtoTCP},
+		"8080:80":               {HostPort: 8080, GuestPort: 80, Proto: ProtoTCP},
+		"127.0.0.1:5353:53/udp": {HostIP: "127.0.0.1", HostPort: 5353, GuestPort: 53, Proto: ProtoUDP},
+		"[::1]:8443:443/tcp":    {HostIP: "::1", HostPort: 8443, GuestPort: 443, Proto: ProtoTCP},
+	} {
+		p, err := ParsePortForward(s)
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+			continue
+		}
+		if p != expected {
+			t.Errorf("%s: expected %+v, got %+v", s, expected, p)
+		}
+
+		roundTrip, err := ParsePortForward(p.String())
+		if err != nil {
+			t.Errorf("%s: %v", p, err)
+			continue
+		}
+		if roundTrip != p {
+			t.Errorf("%s: expected %+v, got %+v", p, p, roundTrip)
+		}
+	}
+
+	for _, s := range []string{
+		"",
+		"http",
+		"0",
+		"65536",
+		"80/sctp",
+		"foo:8080:80",
+		":80",
+	} {
+		if _, err := ParsePortForward(s); err == nil {
+			t.Errorf("expected error for %q", s)
+		}
+	}
+}
+
+func TestGuestPorts(t *testing.T) {
+	var f portForwardListFlag
+	if err := f.Set("8080:80,8081:80,53/udp,53"); err != nil {
+		t.Fatal(err)
+	}
+	ports := GuestPorts(f)
+	expected := []PortForward{
+		{GuestPort: 80, Proto: ProtoTCP},
+		{GuestPort: 53, Proto: ProtoUDP},
+		{GuestPort: 53, Proto: ProtoTCP},
+	}
+	if len(ports) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, ports)
+	}
+	for i := range expected {
+		if ports[i] != expected[i] {
+			t.Errorf("expected %+v, got %+v", expected[i], ports[i])
+		}
+	}
+}
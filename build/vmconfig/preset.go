@@ -0,0 +1,132 @@
+package vmconfig
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ReadyFile is the file, relative to the state dir, which is created once the workload in the VM passes its readiness check.
+const ReadyFile = "ready"
+
+// Names of the supported presets.
+const (
+	PresetDockerd    = "dockerd"
+	PresetContainerd = "containerd"
+	PresetPodman     = "podman"
+	PresetK3s        = "k3s"
+	PresetBuildkitd  = "buildkitd"
+)
+
+// DefaultPreset is the workload run in the VM when no preset is specified.
+const DefaultPreset = PresetDockerd
+
+// Preset describes how a workload is run in the VM.
+// The rootfs content for each preset (binaries and init script) is defined in the build package.
+type Preset struct {
+	Name string
+	// InitCmd is the command run in the VM after pid 1.
+	InitCmd string
+	// Sockets are the guest sockets forwarded to the state dir when no socket forwards are specified.
+	Sockets []string
+	// ReadyCmd is run in the VM until it succeeds to determine that the workload is ready.
+	ReadyCmd string
+	// DataDir is where the workload stores its overlay based container storage.
+	// overlayfs cannot use another overlay as its upper layer, so this cannot be on a read-only root's overlay.
+	DataDir string
+}
+
+// Presets are the supported workload presets, keyed by name.
+// The build package installs each preset's init command in the rootfs (see build.Workloads).
+var Presets = map[string]Preset{
+	PresetDockerd: {
+		Name:     PresetDockerd,
+		InitCmd:  "/usr/local/bin/dockerd-init",
+		Sockets:  []string{"/run/docker.sock"},
+		ReadyCmd: "docker version",
+		DataDir:  "/var/lib/docker",
+	},
+	PresetContainerd: {
+		Name:     PresetContainerd,
+		InitCmd:  "/usr/local/bin/containerd-init",
+		Sockets:  []string{"/run/containerd/containerd.sock"},
+		ReadyCmd: "ctr version",
+		DataDir:  "/var/lib/containerd",
+	},
+	PresetPodman: {
+		Name:     PresetPodman,
+		InitCmd:  "/usr/local/bin/podman-init",
+		Sockets:  []string{"/run/podman/podman.sock"},
+		ReadyCmd: "podman --remote --url unix:///run/podman/podman.sock version",
+		DataDir:  "/var/lib/containers",
+	},
+	PresetK3s: {
+		Name:     PresetK3s,
+		InitCmd:  "/usr/local/bin/k3s-init",
+		Sockets:  []string{"/run/k3s/containerd/containerd.sock"},
+		ReadyCmd: "k3s kubectl get --raw=/readyz",
+		DataDir:  "/var/lib/rancher",
+	},
+	PresetBuildkitd: {
+		Name:     PresetBuildkitd,
+		InitCmd:  "/usr/local/bin/buildkitd-init",
+		Sockets:  []string{"/run/buildkit/buildkitd.sock"},
+		ReadyCmd: "buildctl debug workers",
+		DataDir:  "/var/lib/buildkit",
+	},
+}
+
+// PresetNames returns the sorted names of all supported presets.
+func PresetNames() []string {
+	names := make([]string, 0, len(Presets))
+	for name := range Presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetPreset looks up a preset by name.
+func GetPreset(name string) (Preset, error) {
+	p, ok := Presets[name]
+	if !ok {
+		return Preset{}, fmt.Errorf("unsupported preset %q, must be one of: %s", name, strings.Join(PresetNames(), ", "))
+	}
+	return p, nil
+}
+
+// ApplyPreset fills in the init command and socket forwards from the preset, unless they were set explicitly.
+// The init command is not filled in when booting a disk, it would not have the preset's rootfs content.
+func (c *VMConfig) ApplyPreset() error {
+	p, err := GetPreset(c.Preset)
+	if err != nil {
+		return err
+	}
+	if c.InitCmd == "" && c.Disk == "" {
+		c.InitCmd = p.InitCmd
+	}
+	if len(c.SocketForwards) == 0 {
+		c.SocketForwards = append(c.SocketForwards, p.Sockets...)
+	}
+	return nil
+}
+
+// ValidateReadOnlyRoot checks that the workload of the preset can run on a read-only root, which is an overlay.
+// Its data dir must be on a data disk for that.
+func (c VMConfig) ValidateReadOnlyRoot() error {
+	p, err := GetPreset(c.Preset)
+	if err != nil {
+		return err
+	}
+	// A custom init command may not run the workload at all.
+	if p.DataDir == "" || c.InitCmd != p.InitCmd {
+		return nil
+	}
+	for _, d := range c.DataDisks {
+		if path.Clean(d.Mount) == p.DataDir {
+			return nil
+		}
+	}
+	return fmt.Errorf("the %s preset does not work on a read-only root, its storage cannot be on the root overlay: add a data disk for it, e.g. --data-disk=name=%s,size=20G,mount=%s", p.Name, p.Name, p.DataDir)
+}
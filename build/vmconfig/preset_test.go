@@ -0,0 +1,58 @@
+package vmconfig
+
+import "testing"
+
+func TestApplyPreset(t *testing.T) {
+	cfg := VMConfig{Preset: "containerd"}
+	if err := cfg.ApplyPreset(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.InitCmd != "/usr/local/bin/containerd-init" {
+		t.Errorf("unexpected init command: %s", cfg.InitCmd)
+	}
+	if len(cfg.SocketForwards) != 1 || cfg.SocketForwards[0] != "/run/containerd/containerd.sock" {
+		t.Errorf("unexpected socket forwards: %v", cfg.SocketForwards)
+	}
+
+	cfg = VMConfig{Preset: "dockerd", InitCmd: "/bin/sh", SocketForwards: socketListFlag{"/run/foo.sock"}}
+	if err := cfg.ApplyPreset(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.InitCmd != "/bin/sh" || len(cfg.SocketForwards) != 1 || cfg.SocketForwards[0] != "/run/foo.sock" {
+		t.Errorf("explicitly set values should be kept: %+v", cfg)
+	}
+
+	// The preset's init script is not on a booted disk.
+	cfg = VMConfig{Preset: "dockerd", Disk: "cloud-image://jammy.img"}
+	if err := cfg.ApplyPreset(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.InitCmd != "" {
+		t.Errorf("init command should not be set from the preset with a disk: %s", cfg.InitCmd)
+	}
+
+	cfg = VMConfig{Preset: "nope"}
+	if err := cfg.ApplyPreset(); err == nil {
+		t.Error("expected error for unknown preset")
+	}
+}
+
+func TestValidateReadOnlyRoot(t *testing.T) {
+	cfg := VMConfig{Preset: "dockerd"}
+	if err := cfg.ApplyPreset(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.ValidateReadOnlyRoot(); err == nil {
+		t.Error("expected error for dockerd without a data disk")
+	}
+
+	cfg.DataDisks = dataDiskListFlag{{Name: "docker", Mount: "/var/lib/docker/"}}
+	if err := cfg.ValidateReadOnlyRoot(); err != nil {
+		t.Errorf("expected data disk to be accepted: %v", err)
+	}
+
+	cfg = VMConfig{Preset: "dockerd", InitCmd: "/bin/sh"}
+	if err := cfg.ValidateReadOnlyRoot(); err != nil {
+		t.Errorf("expected custom init command to be accepted: %v", err)
+	}
+}
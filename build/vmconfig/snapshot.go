@@ -0,0 +1,37 @@
+package vmconfig
+
+import (
+	"fmt"
+	"regexp"
+)
+
+const (
+	// SnapshotsDir is the directory, relative to the state dir, where live snapshots are stored.
+	// Each snapshot is a directory with the files below.
+	SnapshotsDir = "snapshots"
+
+	// SnapshotStateFile holds the VM state saved with qemu migration.
+	SnapshotStateFile = "vmstate"
+	// SnapshotDiskFile is a copy of the root disk overlay at the time of the snapshot.
+	SnapshotDiskFile = "rootfs.qcow2"
+	// SnapshotFlagsFile holds the VM flags the snapshot was taken with.
+	// The restored VM must have the same devices as the saved one.
+	SnapshotFlagsFile = "flags"
+	// SnapshotImageFile holds the image ref the snapshot was taken with.
+	SnapshotImageFile = "image"
+
+	// ControlSocket is the socket, relative to the state dir, used to control a running VM.
+	ControlSocket = "control.sock"
+	// QMPSocket is the qemu machine protocol socket of a running VM, relative to the state dir.
+	QMPSocket = "qmp.sock"
+)
+
+var snapshotNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// ValidateSnapshotName checks that the name is usable as a snapshot name.
+func ValidateSnapshotName(name string) error {
+	if !snapshotNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid snapshot name %q: must be alphanumeric, '-', '_', or '.' characters", name)
+	}
+	return nil
+}
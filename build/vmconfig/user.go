@@ -0,0 +1,28 @@
+package vmconfig
+
+import (
+	"fmt"
+	"regexp"
+)
+
+var userNameRegexp = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+
+// ValidateUserName checks that the name can be used for the guest user.
+func ValidateUserName(name string) error {
+	if !userNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid guest user name %q: must start with a lowercase letter or '_' and only contain lowercase letters, digits, '_', or '-'", name)
+	}
+	return nil
+}
+
+// ValidateGuestUser checks that the guest user can be created with the passed in uid and gid.
+// The guest user is a non-root user, running as root (e.g. with sudo) needs an explicit --uid and --gid.
+func ValidateGuestUser(name string, uid, gid int) error {
+	if err := ValidateUserName(name); err != nil {
+		return err
+	}
+	if uid == 0 || gid == 0 {
+		return fmt.Errorf("guest user %q cannot have uid or gid 0, set --uid and --gid to a non-root user", name)
+	}
+	return nil
+}
@@ -43,7 +43,7 @@ func ArchStringToQemu(arch string) string {
 type VMConfig struct {
 	CPUArch       string
 	NumCPU        int
-	PortForwards  intListFlag
+	PortForwards  portForwardListFlag
 	NoKVM         bool
 	RequireKVM    bool
 	NoMicro       bool
@@ -53,6 +53,35 @@ type VMConfig struct {
 	Uid           int
 	Gid           int
 	InitCmd       string
+	// Net is the networking mode of the VM, see NetModes.
+	Net string
+	// NICs are the network interfaces of the VM, see Interfaces.
+	NICs nicListFlag
+	// Preset is the workload run in the VM, see Presets.
+	Preset string
+	// RootOverlaySize is the size of the scratch disk used as the writable layer for read-only roots.
+	// When empty a tmpfs is used.
+	RootOverlaySize string
+	// DataDisks are disks stored in the state dir which persist across runs.
+	DataDisks dataDiskListFlag
+	// Mounts are host directories shared with the VM.
+	Mounts sharedMountListFlag
+	// Persist keeps the changes made to the root disk in the state dir so they survive restarts.
+	Persist bool
+	// FromSnapshot is the name of a live snapshot in the state dir to restore the VM from instead of booting.
+	FromSnapshot string
+	// Disk is a disk to boot instead of the root disk in the image, see ParseDiskSpec.
+	Disk string
+	// DockerdBin is a file or directory with dockerd, containerd, and runc binaries to use instead of the ones in the rootfs.
+	DockerdBin string
+	// Kind creates a kind cluster in the VM once dockerd is ready, see kindFlag.
+	Kind kindFlag
+	// KindServer is the address the kind API server is reachable at from the host, set by the runner.
+	KindServer string
+	// GuestUser is the name of a non-root user to create in the VM with the same uid/gid as Uid and Gid.
+	GuestUser string
+	// GuestSudo gives the guest user passwordless sudo.
+	GuestSudo bool
 
 	// The code around this was remove so it really doesn't do anything right now.
 	// Keeping for now as fully removing means trashing code that may still be useful.
@@ -73,9 +102,41 @@ func (c VMConfig) AsFlags() []string {
 		"--gid=" + strconv.Itoa(c.Gid),
 		"--require-kvm=" + strconv.FormatBool(c.RequireKVM),
 		"--init-cmd", c.InitCmd,
+		"--preset=" + c.Preset,
+		"--net=" + c.Net,
+	}
+	if c.RootOverlaySize != "" {
+		flags = append(flags, "--root-overlay-size="+c.RootOverlaySize)
+	}
+	if c.Persist {
+		flags = append(flags, "--persist")
+	}
+	if c.FromSnapshot != "" {
+		flags = append(flags, "--from-snapshot="+c.FromSnapshot)
+	}
+	if c.DockerdBin != "" {
+		flags = append(flags, "--dockerd-bin="+c.DockerdBin)
+	}
+	if c.Kind != "" {
+		flags = append(flags, "--kind="+string(c.Kind), "--kind-server="+c.KindServer)
+	}
+	if c.GuestUser != "" {
+		flags = append(flags, "--guest-user="+c.GuestUser, "--guest-sudo="+strconv.FormatBool(c.GuestSudo))
+	}
+	if c.Disk != "" {
+		flags = append(flags, "--disk="+c.Disk)
+	}
+	for _, d := range c.DataDisks {
+		flags = append(flags, "--data-disk="+d.String())
+	}
+	for _, m := range c.Mounts {
+		flags = append(flags, "--mount="+m.String())
+	}
+	for _, n := range c.NICs {
+		flags = append(flags, "--nic="+n.String())
 	}
 	if len(c.PortForwards) > 0 {
-		flags = append(flags, "--vm-port-forward="+strings.Join(convertPortForwards(c.PortForwards), ","))
+		flags = append(flags, "--vm-port-forward="+c.PortForwards.String())
 	}
 	if len(c.SocketForwards) > 0 {
 		flags = append(flags, "--vm-socket-forward="+strings.Join(c.SocketForwards, ","))
@@ -93,13 +154,27 @@ func AddVMFlags(set *flag.FlagSet, cfg *VMConfig) {
 	set.StringVar(&cfg.Memory, "memory", "4G", "memory to use for the VM")
 	set.StringVar(&cfg.CPUArch, "cpu-arch", GetDefaultCPUArch(), "CPU architecture to use for the VM")
 	set.BoolVar(&cfg.NoMicro, "no-micro", false, "disable microVMs - useful for allowing the VM to have access to PCI devices")
-	set.Var(&cfg.PortForwards, "vm-port-forward", "port forwards to set up from the VM")
+	set.Var(&cfg.PortForwards, "vm-port-forward", "port forwards to set up from the VM, comma separated and can be specified multiple times ([[hostip:]hostport:]guestport[/tcp|/udp]), a random host port is used when hostport is not set")
 	set.BoolVar(&cfg.DebugConsole, "debug-console", false, "enable debug console")
 	set.IntVar(&cfg.Uid, "uid", os.Getuid(), "uid to use for the VM")
 	set.IntVar(&cfg.Gid, "gid", os.Getgid(), "gid to use for the VM")
 	set.BoolVar(&cfg.RequireKVM, "require-kvm", false, "require KVM to be available (will fail if not available)")
-	set.StringVar(&cfg.InitCmd, "init-cmd", "/usr/local/bin/dockerd-init", "command to run in the VM (after pid 1)")
-	set.Var(&cfg.SocketForwards, "vm-socket-forward", "socket forwards to set up from the VM (--vm-socket-foroward=<guest path>)")
+	set.StringVar(&cfg.InitCmd, "init-cmd", "", "command to run in the VM (after pid 1), defaults to the init script of the preset. With --disk it is run by cloud-init instead and has no default")
+	set.StringVar(&cfg.Preset, "preset", DefaultPreset, "workload to run in the VM ("+strings.Join(PresetNames(), ", ")+"), sets the init command, the default socket forwards, and the readiness check")
+	set.StringVar(&cfg.Net, "net", NetUser, "networking mode of the VM ("+strings.Join(NetModes, ", ")+"), tap bridges the VM in the runner container which is faster but needs NET_ADMIN in the container, passt is faster than user and supports IPv6 without needing NET_ADMIN")
+	set.Var(&cfg.NICs, "nic", "network interface for the VM, can be specified multiple times for multiple NICs, each on its own network (--nic=[subnet=<cidr>][,ipv6][,ipv6-prefix=<cidr>][,mac=<mac>]), the first one gets the default route and port forwards")
+	set.StringVar(&cfg.RootOverlaySize, "root-overlay-size", "", "size of the scratch disk used as the writable layer when the root disk is read-only (uses a tmpfs when not set)")
+	set.Var(&cfg.DataDisks, "data-disk", "disk to persist in the state dir across runs and mount in the VM, can be specified multiple times (--data-disk=name=<name>,size=<size>,mount=<guest path>)")
+	set.Var(&cfg.Mounts, "mount", "share a host directory with the VM, can be specified multiple times (--mount=type=virtiofs|9p,source=<host path>,target=<guest path>[,ro])")
+	set.BoolVar(&cfg.Persist, "persist", false, "keep changes to the root disk in the state dir so they survive restarts")
+	set.StringVar(&cfg.FromSnapshot, "from-snapshot", "", "restore the VM from a live snapshot in the state dir instead of booting it (see snapshot --live)")
+	set.StringVar(&cfg.Disk, "disk", "", "boot a disk instead of the root disk in the image (cloud-image://<path to qcow2>), cloud images are booted through firmware with a cloud-init seed which runs --init-cmd")
+	set.StringVar(&cfg.DockerdBin, "dockerd-bin", "", "file or directory (e.g. a moby bundles dir) with dockerd, containerd, and runc binaries to use instead of the ones in the rootfs, without rebuilding it")
+	set.Var(&cfg.Kind, "kind", "create a kind cluster in the VM once dockerd is ready and write its kubeconfig to the state dir (--kind or --kind=<config file>), the API server must listen on 0.0.0.0:6443")
+	set.StringVar(&cfg.KindServer, "kind-server", "", "address the kind API server is reachable at from the host, this is set by the runner")
+	set.StringVar(&cfg.GuestUser, "guest-user", "", "name of a non-root user to create in the VM with the same uid/gid as --uid/--gid, the user gets the ssh key and is added to the docker group")
+	set.BoolVar(&cfg.GuestSudo, "guest-sudo", false, "give the guest user passwordless sudo (requires sudo in the rootfs)")
+	set.Var(&cfg.SocketForwards, "vm-socket-forward", "socket forwards to set up from the VM (--vm-socket-foroward=<guest path>), defaults to the socket of the preset")
 }
 
 var vmxRegexp = regexp.MustCompile(`flags.*:.*(vmx|svm)`)
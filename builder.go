@@ -5,6 +5,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path"
 	"strings"
 
 	nested "github.com/antonfisher/nested-logrus-formatter"
@@ -12,6 +13,7 @@ import (
 	"github.com/cpuguy83/go-docker/transport"
 	"github.com/cpuguy83/qemu-micro-env/build"
 	bkclient "github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
 	"github.com/moby/buildkit/exporter/containerimage/exptypes"
 	gateway "github.com/moby/buildkit/frontend/gateway/client"
 	"github.com/moby/buildkit/identity"
@@ -25,14 +27,28 @@ var mobyExports = []bkclient.ExportEntry{
 }
 
 func buildFlags(set *flag.FlagSet, cfg *config) {
-	set.StringVar(&cfg.ImageConfig.size, "qcow-size", defaultQcowSize, "Size for the created qcow image")
-	set.StringVar(&cfg.ImageConfig.rootfs, "rootfs", "", "Image to get a rootfs from. If empty will use the default rootfs.")
-	set.Var(&cfg.ImageConfig.kernel, "kernel", "kernel spec (docker-image://<image> (assumes /boot/vmlinuz), local://<path to vmlinuz>, <path to vmlinuz> (same as local://), version://<version> (compile from source))")
+	set.StringVar(&cfg.ImageConfig.size, "qcow-size", defaultQcowSize, "Size for the created qcow image, or auto[+headroom] to size it based on the rootfs content")
+	set.StringVar(&cfg.ImageConfig.fs, "rootfs-fs", "", "Filesystem to use for the root disk ("+strings.Join(build.RootFilesystems, ", ")+", or "+strings.Join(build.ReadOnlyRootFilesystems, ", ")+" with --root-mode=ro). Defaults to ext4, or squashfs for read-only roots.")
+	set.StringVar(&cfg.ImageConfig.rootMode, "root-mode", rootModeReadWrite, "Mount mode of the root disk (rw, ro). With ro a compressed read-only root is created and the VM gets a writable overlay on top of it which is discarded on exit.")
+	set.Var(&cfg.ImageConfig.rootfs, "rootfs", "rootfs spec (docker-image://<image>, <image> (same as docker-image://, used as is), dockerfile://<path>[#target], local://<dir>, tar://<file>). If empty will use the default rootfs.")
+	set.StringVar(&cfg.ImageConfig.distro, "distro", build.DistroJammy.Name, "Distro to use for the default rootfs and to install packages with ("+strings.Join(build.DistroNames(), ", ")+")")
+	set.Var(&cfg.ImageConfig.packages, "package", "Extra package to install in the rootfs, as name or name=version (can be specified multiple times)")
+	set.Var(&cfg.ImageConfig.runs, "run", "Shell command to run in the rootfs after packages are installed and files are copied in (can be specified multiple times)")
+	set.Var(&cfg.ImageConfig.moby, "moby", "moby (dockerd) spec, ignored for docker-image:// rootfs (docker-image://<image> (binaries are taken from $PATH or /), static://<version> (official static release), local://<dir> (binaries found in dir, e.g. a moby bundles dir, the rest come from the default image)). Defaults to docker-image://"+build.MobyRef)
+	set.StringVar(&cfg.ImageConfig.mobyURL, "moby-static-url", build.MobyStaticURL, "Base URL for static:// moby releases, releases are downloaded from <url>/<arch>/docker-<version>.tgz")
+	set.Var(&cfg.ImageConfig.copyIns, "copy-in", "Copy a file or directory from the host into the rootfs, as <host path>:<guest path>[:mode] with an octal mode (can be specified multiple times)")
+	set.Var(&cfg.ImageConfig.kernel, "kernel", "kernel spec (docker-image://<image> (assumes /boot/vmlinuz), local://<path to vmlinuz>, <path to vmlinuz> (same as local://), version://<version> (compile from source, version can also be one of latest, stable, longterm[/<major>.<minor>], or <major>.<minor> for the latest patch release))")
+	set.StringVar(&cfg.ImageConfig.kernelIndex, "kernel-index", build.KernelReleasesURL, "URL of the kernel.org style releases.json index used to resolve kernel version aliases")
+	set.StringVar(&cfg.ImageConfig.kernelLock, "kernel-lock", "", "Path to a lock file to record the resolved kernel version and checksum in. If the file exists and matches the kernel spec, the locked release is used.")
 	set.Var(&cfg.ImageConfig.initrd, "initrd", "initrd spec (docker-image://<image> (assumes /boot/initrd.img), local://<path to initrd.img>, <path to initrd.img> (same as local://))")
 	set.Var(&cfg.ImageConfig.modules, "modules", "kernel modules spec (docker-image://<image> (assumes /lib/modules), local://<path to modules dir>, <path to modules dir> (same as local://))")
 	set.StringVar(&cfg.CacheSpec, "remote-cache", os.Getenv("BUILDKIT_REMOTE_CACHE"), "Buildkit remote cache spec, default comes from the BUILDKIT_REMOTE_CACHE environment variable")
 	set.StringVar(&cfg.Tag, "t", "", "Tag the produced image")
 	set.BoolVar(&cfg.Push, "push", false, "Push the produced image")
+	if set.Lookup("preset") == nil {
+		set.StringVar(&cfg.VM.Preset, "preset", cfg.VM.Preset, "Workload to install in the rootfs ("+strings.Join(build.WorkloadNames(), ", ")+"), ignored for docker-image:// rootfs. Pass the same preset to run.")
+	}
+	set.StringVar(&cfg.KernelCheck, "kernel-check", kernelCheckWarn, "Check the kernel config against the requirements of the init command before booting (warn, error, off)")
 }
 
 func checkMergeOp(ctx context.Context, client gateway.Client) {
@@ -146,11 +162,15 @@ func gatewayBuildFunc(cfg config) gateway.BuildFunc {
 	return func(ctx context.Context, client gateway.Client) (*gateway.Result, error) {
 		checkMergeOp(ctx, client)
 
-		spec, err := specFromFlags(ctx, cfg.ImageConfig)
+		spec, err := specFromFlags(ctx, client, cfg.ImageConfig)
 		if err != nil {
 			return nil, err
 		}
 
+		if err := checkKernel(ctx, client, cfg, spec.Kernel); err != nil {
+			return nil, err
+		}
+
 		img, err := mkImage(ctx, spec)
 		if err != nil {
 			return nil, fmt.Errorf("error building image LLB: %w", err)
@@ -167,6 +187,155 @@ func gatewayBuildFunc(cfg config) gateway.BuildFunc {
 		if err != nil {
 			return nil, fmt.Errorf("error solving: %w", err)
 		}
+
+		logDiskInfo(ctx, res)
 		return res, nil
 	}
 }
+
+// logDiskInfo reports the details of the created root disk.
+func logDiskInfo(ctx context.Context, res *gateway.Result) {
+	ref, err := res.SingleRef()
+	if err != nil {
+		return
+	}
+	dt, err := ref.ReadFile(ctx, gateway.ReadRequest{Filename: build.QcowInfoPath})
+	if err != nil {
+		logrus.WithError(err).Debug("Could not read root disk info")
+		return
+	}
+
+	fields := logrus.Fields{}
+	for _, line := range strings.Split(strings.TrimSpace(string(dt)), "\n") {
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		fields[k] = v
+	}
+	logrus.WithFields(fields).Info("Created root disk")
+}
+
+const (
+	kernelCheckWarn  = "warn"
+	kernelCheckError = "error"
+	kernelCheckOff   = "off"
+
+	kernelConfigPath = "/config"
+)
+
+// checkKernel validates the kernel config against what the configured init command needs.
+// This is much cheaper than finding out from a failed boot.
+func checkKernel(ctx context.Context, client gateway.Client, cfg config, k build.Kernel) error {
+	switch cfg.KernelCheck {
+	case kernelCheckOff:
+		return nil
+	case kernelCheckWarn, kernelCheckError:
+	default:
+		return fmt.Errorf("invalid value for kernel-check: %q", cfg.KernelCheck)
+	}
+
+	dt, err := readKernelConfig(ctx, client, k)
+	if err != nil {
+		return err
+	}
+	if dt == nil {
+		logrus.Warn("No kernel config available, skipping kernel feature check")
+		return nil
+	}
+
+	var mountTypes []string
+	for _, m := range cfg.VM.Mounts {
+		mountTypes = append(mountTypes, m.Type)
+	}
+	required := build.KernelRequirementsFor(cfg.VM.InitCmd, cfg.VM.CgroupVersion, mountTypes...)
+	result := build.CheckKernelConfig(build.ParseKernelConfig(dt), required)
+
+	for _, opt := range result.Modules {
+		logrus.WithField("option", opt).Warn("Kernel option is only available as a module")
+	}
+	for _, opt := range result.Missing {
+		logrus.WithField("option", opt).Warn("Kernel option is missing")
+	}
+
+	if len(result.Missing) > 0 && cfg.KernelCheck == kernelCheckError {
+		return fmt.Errorf("kernel config is missing required options: %s", strings.Join(result.Missing, ", "))
+	}
+	return nil
+}
+
+// readKernelConfig reads the config of the kernel.
+// The config path may be a pattern such as /boot/config-*, when it matches multiple configs the one for the newest kernel is used.
+// It returns nil when there is no config.
+func readKernelConfig(ctx context.Context, client gateway.Client, k build.Kernel) ([]byte, error) {
+	if k.Config.IsEmpty() {
+		return nil, nil
+	}
+
+	ref, err := solveState(ctx, client, k.Config.WithTarget(kernelConfigPath+"/").State())
+	if err != nil {
+		return nil, fmt.Errorf("error solving kernel config: %w", err)
+	}
+	entries, err := ref.ReadDir(ctx, gateway.ReadDirRequest{Path: kernelConfigPath})
+	if err != nil || len(entries) == 0 {
+		// Patterns are allowed to not match anything.
+		return nil, nil
+	}
+
+	name := entries[0].Path
+	for _, e := range entries[1:] {
+		if kernelVersionLess(name, e.Path) {
+			name = e.Path
+		}
+	}
+	logrus.WithField("config", name).Debug("Using kernel config")
+	dt, err := ref.ReadFile(ctx, gateway.ReadRequest{Filename: path.Join(kernelConfigPath, name)})
+	if err != nil {
+		return nil, fmt.Errorf("error reading kernel config: %w", err)
+	}
+	return dt, nil
+}
+
+// kernelVersionLess compares names with kernel versions in them (e.g. config-5.15.0-9-generic) so that numbers compare by value.
+func kernelVersionLess(a, b string) bool {
+	for a != "" && b != "" {
+		na, ra := splitNumber(a)
+		nb, rb := splitNumber(b)
+		switch {
+		case na != "" && nb != "":
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			if na != nb {
+				return na < nb
+			}
+		case a[0] != b[0]:
+			return a[0] < b[0]
+		default:
+			ra, rb = a[1:], b[1:]
+		}
+		a, b = ra, rb
+	}
+	return len(a) < len(b)
+}
+
+// splitNumber splits the leading number, without leading zeros, off of s.
+func splitNumber(s string) (string, string) {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return strings.TrimLeft(s[:i], "0"), s[i:]
+}
+
+func solveState(ctx context.Context, client gateway.Client, st llb.State) (gateway.Reference, error) {
+	def, err := st.Marshal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Solve(ctx, gateway.SolveRequest{Definition: def.ToPB()})
+	if err != nil {
+		return nil, err
+	}
+	return res.SingleRef()
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestKernelVersionLess(t *testing.T) {
+	cases := []struct {
+		a, b string
+	}{
+		{"config-5.15.0-9-generic", "config-5.15.0-10-generic"},
+		{"config-5.15.0-88-generic", "config-6.2.0-1-generic"},
+		{"config-5.4.0", "config-5.15.0"},
+		{"config-6.1", "config-6.1.1"},
+		{"config-6.1.1-rc1", "config-6.1.1-rc2"},
+	}
+	for _, tc := range cases {
+		if !kernelVersionLess(tc.a, tc.b) {
+			t.Errorf("expected %s < %s", tc.a, tc.b)
+		}
+		if kernelVersionLess(tc.b, tc.a) {
+			t.Errorf("expected %s >= %s", tc.b, tc.a)
+		}
+	}
+	if kernelVersionLess("config-6.1", "config-6.1") {
+		t.Error("expected equal names to not be less")
+	}
+}
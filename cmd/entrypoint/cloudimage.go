@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cpuguy83/qemu-micro-env/build/vmconfig"
+)
+
+const (
+	cloudOverlayPath = "/tmp/cloud-image-overlay.qcow2"
+	cloudSeedPath    = "/tmp/cloud-seed.iso"
+	cloudUserName    = "user"
+	aarch64Firmware  = "/usr/share/qemu-efi-aarch64/QEMU_EFI.fd"
+)
+
+// cloudImageArgs returns the qemu args needed to boot a vendor cloud image.
+// Cloud images are booted through firmware with their own kernel, the image itself is not modified since the VM
+// runs off an overlay.
+// A NoCloud seed is passed in to setup the ssh key and run any requested commands.
+func cloudImageArgs(cfg vmconfig.VMConfig, image string, pubKey []byte) ([]string, error) {
+	if out, err := exec.Command("qemu-img", "create", "-q", "-f", "qcow2", "-b", image, "-F", "qcow2", cloudOverlayPath).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("error creating cloud image overlay: %w: %s", err, string(out))
+	}
+	if err := os.Chown(cloudOverlayPath, cfg.Uid, cfg.Gid); err != nil {
+		return nil, err
+	}
+
+	if err := createCloudSeed(cloudSeedPath, cfg, pubKey); err != nil {
+		return nil, err
+	}
+
+	args := []string{
+		// Cloud images have their console on the serial port
+		"-chardev", "stdio,id=con0",
+		"-serial", "chardev:con0",
+
+		"-drive", "id=root,file=" + cloudOverlayPath + ",format=qcow2,if=virtio",
+		"-drive", "id=seed,file=" + cloudSeedPath + ",format=raw,if=virtio,readonly=on",
+	}
+	if cfg.CPUArch == "aarch64" {
+		args = append(args, "-bios", aarch64Firmware)
+	}
+	return args, nil
+}
+
+// cloudMachineType is the machine type used for booting cloud images, which need firmware and PCI devices.
+func cloudMachineType(arch string) []string {
+	if arch == "aarch64" {
+		return []string{"-M", "virt"}
+	}
+	return []string{"-M", "q35"}
+}
+
+// createCloudSeed creates a cloud-init NoCloud seed ISO.
+// Root gets the session ssh key so the ssh based forwarding works the same as for the default image,
+// a user with a uid matching the host user is created as well (named after --guest-user if set).
+// cloud-init runs the init command once the VM is booted.
+func createCloudSeed(p string, cfg vmconfig.VMConfig, pubKey []byte) error {
+	dir, err := os.MkdirTemp("", "cloud-seed")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	userData, err := cloudUserData(cfg, pubKey)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "user-data"), userData, 0644); err != nil {
+		return err
+	}
+
+	// A new instance id makes cloud-init apply the config on every boot.
+	metaData := "instance-id: qemu-micro-env-" + strconv.FormatInt(time.Now().UnixNano(), 10) + "\n" +
+		"local-hostname: qemu-micro-env\n"
+	if err := os.WriteFile(filepath.Join(dir, "meta-data"), []byte(metaData), 0644); err != nil {
+		return err
+	}
+
+	out, err := exec.Command("genisoimage",
+		"-quiet",
+		"-output", p,
+		"-volid", "cidata",
+		"-joliet", "-rock",
+		filepath.Join(dir, "user-data"),
+		filepath.Join(dir, "meta-data"),
+	).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error creating cloud-init seed: %w: %s", err, string(out))
+	}
+	return os.Chown(p, cfg.Uid, cfg.Gid)
+}
+
+// cloudUserData returns the cloud-init user-data for the seed.
+func cloudUserData(cfg vmconfig.VMConfig, pubKey []byte) ([]byte, error) {
+	key := strings.TrimSpace(string(pubKey))
+	userData := map[string]interface{}{
+		"disable_root":        false,
+		"ssh_pwauth":          false,
+		"ssh_authorized_keys": []string{key},
+	}
+	if cfg.Uid != 0 {
+		name := cloudUserName
+		if cfg.GuestUser != "" {
+			name = cfg.GuestUser
+		}
+		userData["users"] = []map[string]interface{}{
+			{
+				"name":                name,
+				"uid":                 cfg.Uid,
+				"shell":               "/bin/bash",
+				"sudo":                "ALL=(ALL) NOPASSWD:ALL",
+				"ssh_authorized_keys": []string{key},
+			},
+		}
+	}
+	// The preset's init command is not the default with --disk (see VMConfig.ApplyPreset), so this is always user supplied.
+	if cfg.InitCmd != "" {
+		userData["runcmd"] = []string{cfg.InitCmd}
+	}
+
+	// JSON is valid YAML so there is no need for a YAML encoder.
+	dt, err := json.MarshalIndent(userData, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("#cloud-config\n"), dt...), nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/cpuguy83/qemu-micro-env/build/vmconfig"
+)
+
+func TestCloudUserData(t *testing.T) {
+	type user struct {
+		Name string   `json:"name"`
+		Uid  int      `json:"uid"`
+		Keys []string `json:"ssh_authorized_keys"`
+	}
+	type userData struct {
+		Keys   []string `json:"ssh_authorized_keys"`
+		Users  []user   `json:"users"`
+		RunCmd []string `json:"runcmd"`
+	}
+
+	parse := func(cfg vmconfig.VMConfig) userData {
+		t.Helper()
+		dt, err := cloudUserData(cfg, []byte("ssh-ed25519 AAAA test\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := string(dt)
+		if !strings.HasPrefix(s, "#cloud-config\n") {
+			t.Fatalf("missing cloud-config header: %q", s)
+		}
+		var ud userData
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(s, "#cloud-config\n")), &ud); err != nil {
+			t.Fatal(err)
+		}
+		if len(ud.Keys) != 1 || ud.Keys[0] != "ssh-ed25519 AAAA test" {
+			t.Errorf("unexpected root keys: %v", ud.Keys)
+		}
+		return ud
+	}
+
+	cfg := vmconfig.VMConfig{Preset: "dockerd", Disk: "cloud-image://jammy.img"}
+	if err := cfg.ApplyPreset(); err != nil {
+		t.Fatal(err)
+	}
+	ud := parse(cfg)
+	if ud.RunCmd != nil || ud.Users != nil {
+		t.Errorf("expected no runcmd or users: %+v", ud)
+	}
+
+	// The init command is run even when it matches the preset's.
+	for _, initCmd := range []string{"apt-get install -y docker.io", vmconfig.Presets["dockerd"].InitCmd} {
+		cfg := vmconfig.VMConfig{Preset: "dockerd", Disk: "cloud-image://jammy.img", InitCmd: initCmd}
+		if err := cfg.ApplyPreset(); err != nil {
+			t.Fatal(err)
+		}
+		if ud := parse(cfg); len(ud.RunCmd) != 1 || ud.RunCmd[0] != initCmd {
+			t.Errorf("unexpected runcmd: %v", ud.RunCmd)
+		}
+	}
+
+	ud = parse(vmconfig.VMConfig{Uid: 1000})
+	if len(ud.Users) != 1 || ud.Users[0].Name != cloudUserName || ud.Users[0].Uid != 1000 || len(ud.Users[0].Keys) != 1 {
+		t.Errorf("unexpected users: %+v", ud.Users)
+	}
+	ud = parse(vmconfig.VMConfig{Uid: 1000, GuestUser: "me"})
+	if len(ud.Users) != 1 || ud.Users[0].Name != "me" {
+		t.Errorf("unexpected users: %+v", ud.Users)
+	}
+}
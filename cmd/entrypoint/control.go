@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cpuguy83/qemu-micro-env/build/vmconfig"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// controller handles requests to control the running VM.
+// Requests are sent as a single line over the control socket in the state dir,
+// the response is the output of the request, if any, followed by a line with either "ok" or "error: <message>".
+type controller struct {
+	cfg   vmconfig.VMConfig
+	mon   *monitor
+	ports *portForwarder
+	// rootDisk is the writable root disk which needs to be saved along with the VM state.
+	// This is empty when the root disk is read-only.
+	rootDisk string
+	// acpi is set when the VM has ACPI (cloud images), otherwise it is powered down through its init.
+	acpi bool
+
+	mu sync.Mutex
+	// guest is set once ssh to the VM is up.
+	guest *guestSSH
+}
+
+func (c *controller) setGuest(g *guestSSH) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.guest = g
+}
+
+func listenControl(uid, gid int) (net.Listener, error) {
+	p := filepath.Join(stateDir, vmconfig.ControlSocket)
+	unix.Unlink(p)
+	l, err := net.Listen("unix", p)
+	if err != nil {
+		return nil, fmt.Errorf("error creating control socket: %w", err)
+	}
+	if err := os.Chown(p, uid, gid); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("error setting control socket ownership: %w", err)
+	}
+	return l, nil
+}
+
+// chownQMPSocket gives the VM user access to the QMP socket.
+// qemu creates the socket before it drops privileges, so it is owned by root.
+func chownQMPSocket(ctx context.Context, uid, gid int) error {
+	p := filepath.Join(stateDir, vmconfig.QMPSocket)
+	for {
+		err := os.Chown(p, uid, gid)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func (c *controller) serve(ctx context.Context, l net.Listener) {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			out, err := c.handle(ctx, conn)
+			if err != nil {
+				logrus.WithError(err).Error("control request failed")
+				fmt.Fprintf(conn, "error: %v\n", err)
+				return
+			}
+			if out != "" {
+				fmt.Fprintln(conn, out)
+			}
+			fmt.Fprintln(conn, "ok")
+		}()
+	}
+}
+
+func (c *controller) handle(ctx context.Context, conn io.Reader) (string, error) {
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("error reading request: %w", err)
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty request")
+	}
+
+	switch fields[0] {
+	case "save":
+		if len(fields) != 3 {
+			return "", fmt.Errorf("usage: save <name> <image>")
+		}
+		return "", c.saveSnapshot(ctx, fields[1], fields[2])
+	case "port-add", "port-rm":
+		if len(fields) != 2 {
+			return "", fmt.Errorf("usage: %s <guestport>[/tcp|/udp]", fields[0])
+		}
+		p, err := vmconfig.ParsePortForward(fields[1])
+		if err != nil {
+			return "", err
+		}
+		if fields[0] == "port-rm" {
+			return "", c.ports.remove(p)
+		}
+		return c.ports.add(p)
+	case "port-ls":
+		return c.ports.list(), nil
+	case "powerdown":
+		return "", c.powerdown(ctx)
+	default:
+		return "", fmt.Errorf("unknown request: %s", fields[0])
+	}
+}
+
+// powerdown asks the VM to shut down.
+// Without ACPI there is no power button to press, so init in the VM is signalled over ssh instead.
+func (c *controller) powerdown(ctx context.Context) error {
+	if c.acpi {
+		_, err := c.mon.Run("system_powerdown")
+		return err
+	}
+
+	c.mu.Lock()
+	g := c.guest
+	c.mu.Unlock()
+	if g == nil {
+		return fmt.Errorf("the VM cannot be powered down before it is reachable over ssh")
+	}
+	if out, err := g.Command(ctx, "kill -TERM 1").CombinedOutput(); err != nil {
+		return fmt.Errorf("error signalling init in the VM: %w: %s", err, out)
+	}
+	return nil
+}
+
+// saveSnapshot saves the VM state and the root disk to a live snapshot in the state dir.
+// The VM is paused while the snapshot is taken and continues afterwards.
+// image is the ref of the image the VM runs, which the snapshot must be restored with.
+func (c *controller) saveSnapshot(ctx context.Context, name, image string) (retErr error) {
+	if err := vmconfig.ValidateSnapshotName(name); err != nil {
+		return err
+	}
+	if c.cfg.Disk != "" {
+		return fmt.Errorf("live snapshots are not supported with --disk")
+	}
+	// The content of these disks would no longer match the saved VM state once the VM continues.
+	if len(c.cfg.DataDisks) > 0 {
+		return fmt.Errorf("live snapshots are not supported with data disks")
+	}
+	if c.cfg.RootOverlaySize != "" {
+		return fmt.Errorf("live snapshots are not supported with a scratch disk for the root overlay")
+	}
+	if c.cfg.DockerdBin != "" {
+		return fmt.Errorf("live snapshots are not supported with --dockerd-bin")
+	}
+	if len(c.cfg.Mounts) > 0 {
+		return fmt.Errorf("live snapshots are not supported with shared mounts")
+	}
+	if c.cfg.Kind != "" {
+		return fmt.Errorf("live snapshots are not supported with --kind")
+	}
+
+	dir := filepath.Join(stateDir, vmconfig.SnapshotsDir, name)
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("snapshot %q already exists", name)
+	}
+
+	// Snapshot files are written to a temp dir so a failed save doesn't leave a broken snapshot around.
+	tmp := dir + ".tmp"
+	os.RemoveAll(tmp)
+	if err := mkdirAs(tmp, 0750, c.cfg.Uid, c.cfg.Gid); err != nil {
+		return fmt.Errorf("error creating snapshot dir: %w", err)
+	}
+	defer func() {
+		if retErr != nil {
+			os.RemoveAll(tmp)
+		}
+	}()
+
+	logger := logrus.WithField("snapshot", name)
+	logger.Info("Saving live snapshot")
+
+	if _, err := c.mon.Run("stop"); err != nil {
+		return err
+	}
+	defer func() {
+		if _, err := c.mon.Run("cont"); err != nil {
+			logger.WithError(err).Error("error resuming VM after snapshot")
+		}
+	}()
+
+	// The default migration bandwidth limit is meant for migrating over the network.
+	if _, err := c.mon.Run("migrate_set_parameter max-bandwidth 100G"); err != nil {
+		return err
+	}
+
+	statePath := filepath.Join(tmp, vmconfig.SnapshotStateFile)
+	if _, err := c.mon.Run(`migrate -d "exec:cat > ` + statePath + `"`); err != nil {
+		return err
+	}
+	if err := c.mon.waitMigration(ctx); err != nil {
+		return err
+	}
+
+	// Disks are flushed once migration is complete, so the root disk is consistent with the saved state.
+	if c.rootDisk != "" {
+		if err := copyFile(c.rootDisk, filepath.Join(tmp, vmconfig.SnapshotDiskFile), c.cfg.Uid, c.cfg.Gid); err != nil {
+			return fmt.Errorf("error saving root disk: %w", err)
+		}
+	}
+
+	flags := strings.Join(c.cfg.AsFlags(), "\n")
+	if err := os.WriteFile(filepath.Join(tmp, vmconfig.SnapshotFlagsFile), []byte(flags), 0640); err != nil {
+		return fmt.Errorf("error saving VM flags: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmp, vmconfig.SnapshotImageFile), []byte(image+"\n"), 0640); err != nil {
+		return fmt.Errorf("error saving snapshot image: %w", err)
+	}
+
+	for _, f := range []string{vmconfig.SnapshotStateFile, vmconfig.SnapshotFlagsFile, vmconfig.SnapshotImageFile} {
+		if err := os.Chown(filepath.Join(tmp, f), c.cfg.Uid, c.cfg.Gid); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(tmp, dir); err != nil {
+		return fmt.Errorf("error moving snapshot into place: %w", err)
+	}
+	logger.Info("Saved live snapshot")
+	return nil
+}
+
+func copyFile(src, dst string, uid, gid int) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chown(dst, uid, gid)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/cpuguy83/qemu-micro-env/build/vmconfig"
+	"github.com/docker/go-units"
+	"github.com/sirupsen/logrus"
+)
+
+// stateDir is where the runner mounts the state dir in the container.
+const stateDir = "/tmp/sockets"
+
+// createScratchDisk creates a sparse ext4 formatted disk image at the passed in path.
+// The image is owned by the passed in uid/gid so qemu can still open it after dropping privileges.
+func createScratchDisk(p, size string, uid, gid int) error {
+	sz, err := units.RAMInBytes(size)
+	if err != nil {
+		return fmt.Errorf("error parsing scratch disk size: %w", err)
+	}
+
+	if err := os.Truncate(p, 0); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error resetting scratch disk: %w", err)
+	}
+
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("error creating scratch disk: %w", err)
+	}
+	err = f.Truncate(sz)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("error sizing scratch disk: %w", err)
+	}
+
+	if out, err := exec.Command("mkfs.ext4", "-q", "-F", p).CombinedOutput(); err != nil {
+		return fmt.Errorf("error formatting scratch disk: %w: %s", err, string(out))
+	}
+
+	if err := os.Chown(p, uid, gid); err != nil {
+		return fmt.Errorf("error setting scratch disk ownership: %w", err)
+	}
+	return nil
+}
+
+// ensureDataDisk returns the path to the qcow2 file backing the data disk, creating it on first use.
+// The disk is left unformatted, init in the VM formats it when it is empty.
+func ensureDataDisk(d vmconfig.DataDisk, uid, gid int) (string, error) {
+	dir := filepath.Join(stateDir, vmconfig.VolumesDir)
+	p := filepath.Join(dir, d.Name+".qcow2")
+
+	if _, err := os.Stat(p); err == nil {
+		logrus.WithField("disk", d.Name).Debug("using existing data disk")
+		return p, nil
+	}
+
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return "", fmt.Errorf("error creating volumes dir: %w", err)
+	}
+	if err := os.Chown(dir, uid, gid); err != nil {
+		return "", fmt.Errorf("error setting volumes dir ownership: %w", err)
+	}
+
+	sz, err := units.RAMInBytes(d.Size)
+	if err != nil {
+		return "", fmt.Errorf("error parsing size of data disk %q: %w", d.Name, err)
+	}
+
+	logrus.WithField("disk", d.Name).WithField("size", d.Size).Info("creating data disk")
+	if out, err := exec.Command("qemu-img", "create", "-q", "-f", "qcow2", p, fmt.Sprint(sz)).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("error creating data disk %q: %w: %s", d.Name, err, string(out))
+	}
+	if err := os.Chown(p, uid, gid); err != nil {
+		return "", fmt.Errorf("error setting data disk ownership: %w", err)
+	}
+	return p, nil
+}
+
+// ensurePersistedDisk returns the path to the root disk overlay in the state dir, creating it on first use.
+// The overlay is created from the (empty) overlay in the image so it shares the same backing file.
+func ensurePersistedDisk(uid, gid int) (string, error) {
+	p := filepath.Join(stateDir, vmconfig.PersistedRootDisk)
+	if _, err := os.Stat(p); err == nil {
+		logrus.Debug("using persisted root disk")
+		return p, nil
+	}
+
+	if err := copyFile(rootfsDiffPath, p, uid, gid); err != nil {
+		return "", fmt.Errorf("error creating persisted root disk: %w", err)
+	}
+	return p, nil
+}
+
+// dockerdBinaries are the binaries that can be injected into the VM with --dockerd-bin.
+var dockerdBinaries = map[string]bool{
+	"docker":                  true,
+	"dockerd":                 true,
+	"docker-init":             true,
+	"docker-proxy":            true,
+	"containerd":              true,
+	"containerd-shim-runc-v2": true,
+	"ctr":                     true,
+	"runc":                    true,
+}
+
+// createBinDisk creates an ext4 disk image with the dockerd binaries found in src.
+// src is either a single binary or a directory which is searched for the binaries, such as a moby bundles dir.
+// Init in the VM mounts the binaries over the ones in the rootfs.
+func createBinDisk(src, p string, uid, gid int) error {
+	dir, err := os.MkdirTemp("", "dockerd-bin")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		total int64
+		found []string
+	)
+	add := func(bin string) error {
+		name := filepath.Base(bin)
+		dst := filepath.Join(dir, name)
+		if err := copyFile(bin, dst, 0, 0); err != nil {
+			return fmt.Errorf("error copying %s: %w", bin, err)
+		}
+		if err := os.Chmod(dst, 0755); err != nil {
+			return err
+		}
+		fi, err := os.Stat(dst)
+		if err != nil {
+			return err
+		}
+		total += fi.Size()
+		found = append(found, name)
+		return nil
+	}
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		if !dockerdBinaries[filepath.Base(src)] {
+			return fmt.Errorf("%s is not one of the binaries that can be injected", filepath.Base(src))
+		}
+		if err := add(src); err != nil {
+			return err
+		}
+	} else {
+		seen := make(map[string]bool)
+		err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || !dockerdBinaries[d.Name()] || seen[d.Name()] {
+				return nil
+			}
+			seen[d.Name()] = true
+			return add(p)
+		})
+		if err != nil {
+			return fmt.Errorf("error searching for dockerd binaries: %w", err)
+		}
+	}
+
+	if len(found) == 0 {
+		return fmt.Errorf("no dockerd binaries found in %s", src)
+	}
+	logrus.WithField("binaries", found).Info("injecting binaries into the VM")
+
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	// Leave room for filesystem metadata
+	err = f.Truncate(total + 32*1024*1024)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	if out, err := exec.Command("mkfs.ext4", "-q", "-F", "-d", dir, p).CombinedOutput(); err != nil {
+		return fmt.Errorf("error creating binaries disk: %w: %s", err, string(out))
+	}
+	return os.Chown(p, uid, gid)
+}
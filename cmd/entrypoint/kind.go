@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cpuguy83/qemu-micro-env/build/vmconfig"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	kindVersion     = "v0.20.0"
+	kindURL         = "https://kind.sigs.k8s.io/dl"
+	kindClusterName = "qemu-micro-env"
+	kindGuestBin    = "/usr/local/bin/kind"
+	kindGuestConfig = "/tmp/kind.yml"
+)
+
+// kindChecksums are the sha256 checksums of the kind binaries for kindVersion, keyed by arch.
+// They must be updated together with kindVersion.
+var kindChecksums = map[string]string{
+	"amd64": "513a7213d6d3332dd9ef27c24dab35e5ef10a04fa27274fe1c14d8a246493ded",
+	"arm64": "639f7808443559aa30c3642d9913b1615d611a071e34f122340afeda97b8f422",
+}
+
+// kindDefaultConfig is used when --kind is passed without a config file.
+// The API server must listen on all addresses on the port that is forwarded from the VM.
+const kindDefaultConfig = `kind: Cluster
+apiVersion: kind.x-k8s.io/v1alpha4
+networking:
+  apiServerAddress: "0.0.0.0"
+  apiServerPort: 6443
+`
+
+var kubeconfigServerRegexp = regexp.MustCompile(`(?m)^(\s*server:\s*)https://\S+$`)
+
+// kindCluster manages a kind cluster running on the dockerd in the VM.
+type kindCluster struct {
+	cfg vmconfig.VMConfig
+	g   *guestSSH
+
+	// mu protects the fields below, it is not held while kind runs so delete can cancel a create in progress.
+	mu      sync.Mutex
+	created bool
+	deleted bool
+	cancel  context.CancelFunc
+}
+
+// create creates the cluster and writes its kubeconfig to the state dir.
+// The kind binary is downloaded on first use and cached in the state dir.
+func (k *kindCluster) create(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	k.mu.Lock()
+	if k.deleted {
+		k.mu.Unlock()
+		return fmt.Errorf("kind cluster is being deleted")
+	}
+	k.cancel = cancel
+	k.mu.Unlock()
+
+	bin, err := k.download(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := k.copyToGuest(ctx, bin, kindGuestBin, "0755"); err != nil {
+		return fmt.Errorf("error copying kind to the VM: %w", err)
+	}
+
+	config := kindDefaultConfig
+	if k.cfg.Kind != vmconfig.KindDefaultConfig {
+		dt, err := os.ReadFile(string(k.cfg.Kind))
+		if err != nil {
+			return fmt.Errorf("error reading kind config: %w", err)
+		}
+		config = string(dt)
+	}
+	cmd := k.g.Command(ctx, "cat > "+kindGuestConfig)
+	cmd.Stdin = strings.NewReader(config)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("error copying kind config to the VM: %w: %s", err, out)
+	}
+
+	// A create that fails or is cancelled can leave nodes behind, so delete must clean up from here on.
+	k.mu.Lock()
+	k.created = true
+	k.mu.Unlock()
+
+	logrus.Info("Creating kind cluster")
+	out, err := k.g.Command(ctx, kindGuestBin+" create cluster --name "+kindClusterName+" --config "+kindGuestConfig+" --wait 5m").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error creating kind cluster: %w: %s", err, out)
+	}
+
+	kubeconfig, err := k.g.Command(ctx, kindGuestBin+" get kubeconfig --name "+kindClusterName).Output()
+	if err != nil {
+		return fmt.Errorf("error getting kind kubeconfig: %w", err)
+	}
+	// The server address in the kubeconfig is only reachable from inside the VM.
+	kubeconfig = kubeconfigServerRegexp.ReplaceAll(kubeconfig, []byte("${1}https://"+k.cfg.KindServer))
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.deleted {
+		return fmt.Errorf("kind cluster was deleted")
+	}
+
+	p := filepath.Join(stateDir, vmconfig.KindKubeconfig)
+	if err := os.WriteFile(p, kubeconfig, 0600); err != nil {
+		return fmt.Errorf("error writing kubeconfig: %w", err)
+	}
+	if err := os.Chown(p, k.cfg.Uid, k.cfg.Gid); err != nil {
+		return fmt.Errorf("error setting kubeconfig ownership: %w", err)
+	}
+	logrus.WithField("kubeconfig", vmconfig.KindKubeconfig).Info("kind cluster is ready")
+	return nil
+}
+
+// delete deletes the cluster if it was created.
+// A create in progress is cancelled first, and no cluster is created afterwards.
+func (k *kindCluster) delete() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.deleted = true
+	if k.cancel != nil {
+		k.cancel()
+	}
+	if !k.created {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	logrus.Info("Deleting kind cluster")
+	if out, err := k.g.Command(ctx, kindGuestBin+" delete cluster --name "+kindClusterName).CombinedOutput(); err != nil {
+		return fmt.Errorf("error deleting kind cluster: %w: %s", err, out)
+	}
+	k.created = false
+	os.Remove(filepath.Join(stateDir, vmconfig.KindKubeconfig))
+	return nil
+}
+
+// download fetches the kind binary for the VM architecture into the state dir, unless it is already there.
+func (k *kindCluster) download(ctx context.Context) (string, error) {
+	arch := "amd64"
+	if k.cfg.CPUArch == "aarch64" {
+		arch = "arm64"
+	}
+
+	dir := filepath.Join(stateDir, "kind")
+	p := filepath.Join(dir, "kind-"+kindVersion+"-"+arch)
+	if _, err := os.Stat(p); err == nil {
+		return p, nil
+	}
+
+	if err := mkdirAs(dir, 0750, k.cfg.Uid, k.cfg.Gid); err != nil {
+		return "", err
+	}
+
+	u := kindURL + "/" + kindVersion + "/kind-linux-" + arch
+	logrus.WithField("url", u).Info("Downloading kind")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error downloading kind: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error downloading kind: %s", resp.Status)
+	}
+
+	tmp := p + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), resp.Body)
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("error downloading kind: %w", err)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != kindChecksums[arch] {
+		os.Remove(tmp)
+		return "", fmt.Errorf("error downloading kind: checksum mismatch, expected sha256 %s, got %s", kindChecksums[arch], sum)
+	}
+	if err := os.Chown(tmp, k.cfg.Uid, k.cfg.Gid); err != nil {
+		return "", err
+	}
+	return p, os.Rename(tmp, p)
+}
+
+func (k *kindCluster) copyToGuest(ctx context.Context, src, dst, mode string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cmd := k.g.Command(ctx, "cat > "+dst+" && chmod "+mode+" "+dst)
+	cmd.Stdin = f
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, out)
+	}
+	return nil
+}
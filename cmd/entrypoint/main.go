@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
@@ -41,6 +42,10 @@ func doExec(ctx context.Context, args []string) error {
 	vmconfig.AddVMFlags(flags, &cfg)
 	debug := flag.Bool("debug", false, "enable debug logging")
 
+	if len(args) > 0 && args[0] == "snapshot" {
+		return doSnapshot(args[1:])
+	}
+
 	flags.Parse(args)
 
 	if *debug {
@@ -53,7 +58,67 @@ func doExec(ctx context.Context, args []string) error {
 	return execVM(ctx, cfg)
 }
 
+const (
+	kernelDiskPath    = "/boot/kernel.qcow2"
+	kernelDiskSerial  = "kernel"
+	rootfsPath        = "/tmp/rootfs.qcow2"
+	rootfsDiffPath    = "/tmp/rootfs-diff.qcow2"
+	rootfsInfoPath    = "/tmp/rootfs.info"
+	scratchDiskPath   = "/tmp/scratch.img"
+	scratchDiskSerial = "scratch"
+	binDiskPath       = "/tmp/dockerd-bin.img"
+	binDiskSerial     = "dockerd-bin"
+)
+
+// readDiskInfo reads the key=value info file that is created along with the rootfs disk image.
+func readDiskInfo(p string) map[string]string {
+	info := make(map[string]string)
+	dt, err := os.ReadFile(p)
+	if err != nil {
+		logrus.WithError(err).Debug("Could not read disk info")
+		return info
+	}
+	for _, line := range strings.Split(string(dt), "\n") {
+		k, v, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if ok {
+			info[k] = v
+		}
+	}
+	return info
+}
+
 func execVM(ctx context.Context, cfg vmconfig.VMConfig) error {
+	var snapshotDir string
+	if cfg.FromSnapshot != "" {
+		var err error
+		snapshotDir, err = loadSnapshot(&cfg)
+		if err != nil {
+			return err
+		}
+	}
+
+	var cloudImage string
+	if cfg.Disk != "" {
+		_, p, err := vmconfig.ParseDiskSpec(cfg.Disk)
+		if err != nil {
+			return err
+		}
+		if cfg.FromSnapshot != "" || cfg.Persist || len(cfg.DataDisks) > 0 || len(cfg.Mounts) > 0 || cfg.DockerdBin != "" || cfg.UseVsock {
+			return fmt.Errorf("--disk cannot be combined with --from-snapshot, --persist, --data-disk, --mount, --dockerd-bin, or vsock")
+		}
+		cloudImage = p
+		// Cloud images are booted through firmware, which needs a full machine.
+		cfg.NoMicro = true
+	}
+
+	if err := vmconfig.ValidateNetMode(cfg.Net); err != nil {
+		return err
+	}
+	if err := vmconfig.ValidateNICs(cfg.Net, cfg.NICs); err != nil {
+		return err
+	}
+	nics := cfg.Interfaces()
+
 	if !cfg.NoKVM {
 		cfg.NoKVM = !vmconfig.CanUseHostCPU(cfg.CPUArch)
 	}
@@ -96,6 +161,9 @@ func execVM(ctx context.Context, cfg vmconfig.VMConfig) error {
 		deviceSuffix = "-device"
 		machineType = []string{"-M", "microvm" + microvmOpts}
 	}
+	if cloudImage != "" {
+		machineType = cloudMachineType(cfg.CPUArch)
+	}
 
 	device := func(name string, opts ...string) string {
 		out := name + deviceSuffix
@@ -115,67 +183,270 @@ func execVM(ctx context.Context, cfg vmconfig.VMConfig) error {
 		vsockArg = " --vsock "
 	}
 
+	var kernelDiskArg string
+	_, err := os.Stat(kernelDiskPath)
+	if err == nil && cloudImage == "" {
+		kernelDiskArg = " --kernel-disk=" + kernelDiskSerial + " "
+	}
+
+	diskInfo := map[string]string{}
+	if cloudImage == "" {
+		diskInfo = readDiskInfo(rootfsInfoPath)
+	}
+	var binDiskArg string
+	if cfg.DockerdBin != "" {
+		if err := createBinDisk(cfg.DockerdBin, binDiskPath, cfg.Uid, cfg.Gid); err != nil {
+			return err
+		}
+		binDiskArg = " --bin-disk=" + binDiskSerial + " "
+	}
+
+	var guestUserArg string
+	if cfg.GuestUser != "" {
+		if err := vmconfig.ValidateGuestUser(cfg.GuestUser, cfg.Uid, cfg.Gid); err != nil {
+			return err
+		}
+		guestUserArg = " --guest-user=" + cfg.GuestUser + ":" + strconv.Itoa(cfg.Uid) + ":" + strconv.Itoa(cfg.Gid) + " "
+		if cfg.GuestSudo {
+			guestUserArg += " --guest-sudo "
+		}
+	}
+
+	// The first NIC gets the default route and DNS config in the VM.
+	nicArg := " --primary-mac=" + nics[0].MAC + " "
+
+	var dataDiskArgs string
+	for _, d := range cfg.DataDisks {
+		dataDiskArgs += " --data-disk=" + d.Serial() + ":" + d.Mount + " "
+	}
+
+	mountArgs, sharedMountArg, err := sharedMountArgs(ctx, cfg, deviceSuffix)
+	if err != nil {
+		return err
+	}
+
+	var rootfsType string
+	if fs := diskInfo["fs"]; fs != "" {
+		rootfsType = "rootfstype=" + fs + " "
+	}
+
+	rootMode := "rw"
+	rootDriveOpts := ""
+	rootDisk := rootfsDiffPath
+	var rootOverlayArg string
+	if diskInfo["mode"] == "ro" {
+		if cfg.Persist {
+			return fmt.Errorf("--persist is not supported with a read-only root")
+		}
+		if cloudImage == "" {
+			if err := cfg.ValidateReadOnlyRoot(); err != nil {
+				return err
+			}
+		}
+		rootDisk = rootfsPath
+		rootMode = "ro"
+		rootDriveOpts = ",readonly=on"
+		rootOverlayArg = " --root-overlay=tmpfs "
+		if cfg.RootOverlaySize != "" {
+			if err := createScratchDisk(scratchDiskPath, cfg.RootOverlaySize, cfg.Uid, cfg.Gid); err != nil {
+				return err
+			}
+			rootOverlayArg = " --root-overlay=disk:" + scratchDiskSerial + " "
+		}
+	} else if snapshotDir != "" {
+		if err := copyFile(filepath.Join(snapshotDir, vmconfig.SnapshotDiskFile), rootfsSnapshotPath, cfg.Uid, cfg.Gid); err != nil {
+			return fmt.Errorf("error copying snapshot root disk: %w", err)
+		}
+		rootDisk = rootfsSnapshotPath
+	} else if cfg.Persist {
+		var err error
+		rootDisk, err = ensurePersistedDisk(cfg.Uid, cfg.Gid)
+		if err != nil {
+			return err
+		}
+	}
+
 	quiet := " quiet "
 	if logrus.GetLevel() >= logrus.DebugLevel {
 		quiet = " earlyprintk=ttyS0 "
 		debugArg += " --debug "
 	}
 
+	pubKey, privKey, err := generateKeys()
+	if err != nil {
+		return err
+	}
+
 	args := []string{
 		"/usr/bin/qemu-system-" + cfg.CPUArch,
 		"-m", cfg.Memory,
 		"-smp", strconv.Itoa(cfg.NumCPU),
 		"-no-reboot",
-		"-no-acpi",
 		"-nodefaults",
 		"-no-user-config",
 		"-nographic",
 
-		"-device", device("virtio-serial"),
-		"-chardev", "stdio,id=virtiocon0",
-		"-device", "virtconsole,chardev=virtiocon0",
+		// pass through the host's rng device to the guest
+		"-device", device("virtio-rng"),
 
-		"-drive", "id=root,file=/tmp/rootfs.qcow2,format=qcow2,if=none",
-		"-device", device("virtio-blk", "drive=root"),
+		"-monitor", "unix:" + monitorSocketPath + ",server=on,wait=off",
+		"-qmp", "unix:" + filepath.Join(stateDir, vmconfig.QMPSocket) + ",server=on,wait=off",
+	}
 
-		"-kernel", "/boot/vmlinuz",
-		"-initrd", "/boot/initrd.img",
-		"-append", "console=hvc0 root=/dev/vda rw acpi=off reboot=t panic=-1 ip=dhcp " + quiet + "init=/sbin/init - --cgroup-version " + strconv.Itoa(cfg.CgroupVersion) + debugArg + vsockArg + " " + cfg.InitCmd,
+	if cloudImage != "" {
+		cloudArgs, err := cloudImageArgs(cfg, cloudImage, pubKey)
+		if err != nil {
+			return err
+		}
+		args = append(args, cloudArgs...)
+	} else {
+		args = append(args, []string{
+			"-no-acpi",
 
-		// pass through the host's rng device to the guest
-		"-device", device("virtio-rng"),
+			"-device", device("virtio-serial"),
+			"-chardev", "stdio,id=virtiocon0",
+			"-device", "virtconsole,chardev=virtiocon0",
+
+			"-drive", "id=root,file=" + rootDisk + ",format=qcow2,if=none" + rootDriveOpts,
+			"-device", device("virtio-blk", "drive=root"),
+
+			"-kernel", "/boot/vmlinuz",
+			"-initrd", "/boot/initrd.img",
+			"-append", "console=hvc0 root=/dev/vda " + rootMode + " " + rootfsType + "acpi=off reboot=t panic=-1 ip=dhcp " + quiet + "init=/sbin/init - --cgroup-version " + strconv.Itoa(cfg.CgroupVersion) + debugArg + vsockArg + kernelDiskArg + rootOverlayArg + dataDiskArgs + sharedMountArg + binDiskArg + guestUserArg + nicArg + " " + cfg.InitCmd,
+		}...)
 	}
 
+	if snapshotDir != "" {
+		args = append(args, "-incoming", "exec:cat "+filepath.Join(snapshotDir, vmconfig.SnapshotStateFile))
+	}
+
+	if kernelDiskArg != "" {
+		// The kernel disk holds the kernel modules, image, and config and is mounted by init based on the disk serial.
+		args = append(args, []string{
+			"-drive", "id=kernel,file=" + kernelDiskPath + ",format=qcow2,if=none,readonly=on",
+			"-device", device("virtio-blk", "drive=kernel", "serial="+kernelDiskSerial),
+		}...)
+	}
+
+	if rootOverlayArg != "" && cfg.RootOverlaySize != "" {
+		// The scratch disk is the writable layer of the root overlay, it is discarded when the VM exits.
+		args = append(args, []string{
+			"-drive", "id=scratch,file=" + scratchDiskPath + ",format=raw,if=none",
+			"-device", device("virtio-blk", "drive=scratch", "serial="+scratchDiskSerial),
+		}...)
+	}
+
+	if binDiskArg != "" {
+		args = append(args, []string{
+			"-drive", "id=bin,file=" + binDiskPath + ",format=raw,if=none,readonly=on",
+			"-device", device("virtio-blk", "drive=bin", "serial="+binDiskSerial),
+		}...)
+	}
+
+	for _, d := range cfg.DataDisks {
+		p, err := ensureDataDisk(d, cfg.Uid, cfg.Gid)
+		if err != nil {
+			return err
+		}
+		args = append(args, []string{
+			"-drive", "id=" + d.Serial() + ",file=" + p + ",format=qcow2,if=none",
+			"-device", device("virtio-blk", "drive="+d.Serial(), "serial="+d.Serial()),
+		}...)
+	}
+
+	args = append(args, mountArgs...)
+
 	if cfg.NoMicro && cfg.CPUArch == "aarch64" {
 		args = append(args, []string{"-cpu", "cortex-a57", "-machine", "secure=on,virtualization=on"}...)
 	}
 
 	args = append(args, machineType...)
 
-	netAddr := "user,id=net0,net=192.168.76.0/24,dhcpstart=192.168.76.9"
-	var localPorts []int
-	if len(cfg.PortForwards) > 0 {
-		var err error
-		localPorts, err = vmconfig.GetLocalPorts(cfg.PortForwards)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		localPorts []int
+		sshHost    = "127.0.0.1"
+		sshPort    string
+		// The runner publishes the guest ports on the container, so only those need to be forwarded to the VM.
+		guestPorts = vmconfig.GuestPorts(cfg.PortForwards)
+		ports      = newPortForwarder(cfg.Net)
+	)
+	switch cfg.Net {
+	case vmconfig.NetTap:
+		netdevs, err := setupTapNetwork(ctx, nics, guestPorts, cfg.Uid, cfg.Gid)
 		if err != nil {
-			return fmt.Errorf("error getting local ports: %w", err)
+			return fmt.Errorf("error setting up tap networking: %w", err)
+		}
+		for i, nic := range nics {
+			args = append(args, []string{
+				"-netdev", netdevs[i],
+				"-device", device("virtio-net", "netdev="+nic.ID(i), "mac="+nic.MAC),
+			}...)
+		}
+		// Forwarded ports are mapped straight to the guest, so ssh goes there too.
+		_, guestIP, _, err := tapAddrs(nics[0])
+		if err != nil {
+			return err
+		}
+		sshHost = guestIP.String()
+		sshPort = strconv.Itoa(sshGuestPort)
+		ports.guestIP = guestIP
+		for _, p := range guestPorts {
+			ports.track(p, 0, nil)
+		}
+	case vmconfig.NetPasst:
+		netdev, err := startPasst(ctx, cfg.CPUArch, guestPorts, cfg.Uid, cfg.Gid)
+		if err != nil {
+			return fmt.Errorf("error setting up passt networking: %w", err)
+		}
+		args = append(args, []string{
+			"-netdev", netdev,
+			"-device", device("virtio-net", "netdev="+nics[0].ID(0), "mac="+nics[0].MAC),
+		}...)
+		// passt listens on the forwarded ports in the container, so no proxy is needed.
+		sshPort = strconv.Itoa(sshGuestPort)
+		for _, p := range guestPorts {
+			ports.track(p, 0, nil)
+		}
+	default:
+		for i, nic := range nics {
+			dhcpStart, _, err := nic.SubnetIP(9)
+			if err != nil {
+				return err
+			}
+			netAddr := "user,id=" + nic.ID(i) + ",net=" + nic.Subnet + ",dhcpstart=" + dhcpStart.String()
+			// slirp enables IPv6 by default.
+			if nic.IPv6 {
+				netAddr += ",ipv6=on,ipv6-net=" + nic.IPv6Prefix
+			} else {
+				netAddr += ",ipv6=off"
+			}
+			// Ports are only forwarded to the first NIC.
+			if i == 0 && len(guestPorts) > 0 {
+				localPorts, err = vmconfig.GetLocalPorts(guestPorts)
+				if err != nil {
+					return fmt.Errorf("error getting local ports: %w", err)
+				}
+				netAddr += "," + vmconfig.PortForwardsToQemuFlag(localPorts, guestPorts)
+			}
+			args = append(args, []string{
+				"-netdev", netAddr,
+				"-device", device("virtio-net", "netdev="+nic.ID(i), "mac="+nic.MAC),
+			}...)
 		}
-		netAddr += "," + vmconfig.PortForwardsToQemuFlag(localPorts, cfg.PortForwards)
 	}
-	args = append(args, []string{
-		"-netdev", netAddr,
-		"-device", device("virtio-net", "netdev=net0"),
-	}...)
 
 	if cfg.UseVsock {
 		args = append(args, []string{"-device", "vhost-vsock-pci,guest-cid=10"}...)
 		if err := vmconfig.DoVsock(10, cfg.Uid, cfg.Gid); err != nil {
 			return fmt.Errorf("error setting up vsock: %w", err)
 		}
-	} else {
+	} else if cloudImage == "" {
 		// pipes to send ssh keys to the guest
 		args = append(args, []string{
-			"-chardev", "pipe,id=ssh_keys,path=/tmp/sockets/authorized_keys",
+			"-chardev", "pipe,id=ssh_keys,path=" + filepath.Join(stateDir, "authorized_keys"),
 			"-device", device("virtio-serial"),
 			"-device", "virtserialport,chardev=ssh_keys,name=authorized_keys",
 		}...)
@@ -189,9 +460,6 @@ func execVM(ctx context.Context, cfg vmconfig.VMConfig) error {
 
 	logrus.WithField("args", args).Debug("executing qemu")
 
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
 	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -200,22 +468,73 @@ func execVM(ctx context.Context, cfg vmconfig.VMConfig) error {
 		Pdeathsig: syscall.SIGKILL,
 	}
 
-	var sshPort string
 	// For some reason qemu user mode networking doesn't work with docker port forwarding (connections just hang).
 	// So... we'll forward the ports ourselves and use an ephemeral port for the qemu hostfwd spec.
 	for i, port := range localPorts {
-		if cfg.PortForwards[i] == 22 {
+		fwd := guestPorts[i]
+		forward := vmconfig.ForwardPort
+		if fwd.Proto == vmconfig.ProtoUDP {
+			forward = vmconfig.ForwardUDPPort
+		}
+		if fwd.Proto == vmconfig.ProtoTCP && fwd.GuestPort == sshGuestPort {
 			sshPort = strconv.Itoa(port)
 		}
-		if err := vmconfig.ForwardPort(cfg.PortForwards[i], port); err != nil {
-			return fmt.Errorf("error forwarding port: %w", err)
+		closer, err := forward(fwd.GuestPort, port)
+		if err != nil {
+			return fmt.Errorf("error forwarding port %s: %w", fwd.ContainerPort(), err)
+		}
+		ports.track(fwd, port, closer)
+	}
+
+	preset, err := vmconfig.GetPreset(cfg.Preset)
+	if err != nil {
+		return err
+	}
+	// The readiness check only makes sense when the preset's workload is what runs in the VM.
+	var readyCmd string
+	if cloudImage == "" && cfg.InitCmd == preset.InitCmd {
+		readyCmd = preset.ReadyCmd
+	}
+	if err := os.Remove(filepath.Join(stateDir, vmconfig.ReadyFile)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing stale ready file: %w", err)
+	}
+
+	var kind *kindCluster
+	if cfg.Kind != "" {
+		// kind runs its nodes on dockerd and needs the readiness check to know when to start.
+		if cfg.Preset != vmconfig.DefaultPreset || readyCmd == "" {
+			return fmt.Errorf("--kind requires the %s preset and its init command", vmconfig.DefaultPreset)
 		}
+		kind = &kindCluster{cfg: cfg}
+	}
+
+	c := &controller{cfg: cfg, ports: ports, acpi: cloudImage != ""}
+	if rootMode == "rw" {
+		c.rootDisk = rootDisk
 	}
 
 	go func() {
-		if err := doSSH(ctx, "/tmp/sockets", sshPort, cfg.Uid, cfg.Gid, cfg.SocketForwards); err != nil {
+		// Cloud images get the key through the cloud-init seed instead.
+		sendKey := cloudImage == ""
+		g, err := doSSH(ctx, stateDir, sshHost, sshPort, pubKey, privKey, sendKey, cfg.Uid, cfg.Gid, cfg.SocketForwards)
+		if err != nil {
 			logrus.WithError(err).Error("ssh failed")
 			cancel()
+			return
+		}
+		c.setGuest(g)
+		if readyCmd == "" {
+			return
+		}
+		if err := waitReady(ctx, g, stateDir, readyCmd, cfg.Uid, cfg.Gid); err != nil {
+			logrus.WithError(err).Error("error waiting for the VM to be ready")
+			return
+		}
+		if kind != nil {
+			kind.g = g
+			if err := kind.create(ctx); err != nil {
+				logrus.WithError(err).Error("error setting up kind")
+			}
 		}
 	}()
 
@@ -223,12 +542,46 @@ func execVM(ctx context.Context, cfg vmconfig.VMConfig) error {
 	signal.CatchAll(sigCh)
 	defer signal.StopCatch(sigCh)
 
+	controlL, err := listenControl(cfg.Uid, cfg.Gid)
+	if err != nil {
+		return err
+	}
+
+	// Remove the socket of a previous run so it is not chowned before qemu creates the new one.
+	os.Remove(filepath.Join(stateDir, vmconfig.QMPSocket))
+
 	if err := cmd.Start(); err != nil {
 		return fmt.Errorf("error starting qemu: %w", err)
 	}
 
+	go func() {
+		if err := chownQMPSocket(ctx, cfg.Uid, cfg.Gid); err != nil {
+			logrus.WithError(err).Error("error setting up QMP socket")
+		}
+	}()
+
+	go func() {
+		mon, err := dialMonitor(ctx, monitorSocketPath)
+		if err != nil {
+			logrus.WithError(err).Error("error connecting to qemu monitor, VM control is not available")
+			controlL.Close()
+			return
+		}
+		defer mon.Close()
+
+		ports.mon = mon
+		c.mon = mon
+		c.serve(ctx, controlL)
+	}()
+
 	go func() {
 		for sig := range sigCh {
+			if kind != nil && (sig == syscall.SIGINT || sig == syscall.SIGTERM) {
+				// Delete the cluster while the VM is still running so the nodes are stopped cleanly.
+				if err := kind.delete(); err != nil {
+					logrus.WithError(err).Warn("Failed to delete kind cluster")
+				}
+			}
 			if err := cmd.Process.Signal(sig); err != nil {
 				logrus.WithError(err).Warn("Failed to forward signal to qemu")
 			}
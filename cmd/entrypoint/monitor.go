@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// monitorSocketPath is the qemu human monitor socket.
+// This is only available inside the container, control of the VM from the outside goes through the control socket.
+const monitorSocketPath = "/tmp/qemu-monitor.sock"
+
+var monitorPrompt = []byte("(qemu) ")
+
+// monitor is a client for the qemu human monitor protocol.
+type monitor struct {
+	mu   sync.Mutex
+	conn net.Conn
+	rdr  *bufio.Reader
+}
+
+func dialMonitor(ctx context.Context, p string) (*monitor, error) {
+	var d net.Dialer
+	for {
+		conn, err := d.DialContext(ctx, "unix", p)
+		if err == nil {
+			m := &monitor{conn: conn, rdr: bufio.NewReader(conn)}
+			// Consume the banner
+			if _, err := m.readPrompt(); err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("error reading monitor banner: %w", err)
+			}
+			return m, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("error connecting to qemu monitor: %w", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func (m *monitor) readPrompt() (string, error) {
+	var buf []byte
+	for {
+		b, err := m.rdr.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		buf = append(buf, b)
+		if bytes.HasSuffix(buf, monitorPrompt) {
+			return string(bytes.TrimSuffix(buf, monitorPrompt)), nil
+		}
+	}
+}
+
+// Run executes a monitor command and returns its output.
+// The output includes the echoed command.
+func (m *monitor) Run(cmd string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.conn.Write([]byte(cmd + "\n")); err != nil {
+		return "", fmt.Errorf("error sending monitor command %q: %w", cmd, err)
+	}
+	out, err := m.readPrompt()
+	if err != nil {
+		return "", fmt.Errorf("error reading output of monitor command %q: %w", cmd, err)
+	}
+	return out, nil
+}
+
+// waitMigration waits for the current migration to finish.
+func (m *monitor) waitMigration(ctx context.Context) error {
+	for {
+		out, err := m.Run("info migrate")
+		if err != nil {
+			return err
+		}
+		switch {
+		case strings.Contains(out, "Migration status: completed"):
+			return nil
+		case strings.Contains(out, "Migration status: failed"), strings.Contains(out, "Migration status: cancelled"):
+			return fmt.Errorf("migration did not complete: %s", out)
+		}
+
+		select {
+		case <-ctx.Done():
+			m.Run("migrate_cancel")
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func (m *monitor) Close() error {
+	return m.conn.Close()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/cpuguy83/qemu-micro-env/build/vmconfig"
+	"github.com/sirupsen/logrus"
+)
+
+const virtiofsdPath = "/usr/lib/qemu/virtiofsd"
+
+// sharedMountArgs returns the qemu args to share the mounts with the VM along with the init args to mount them.
+// virtiofsd is started for each virtiofs mount, it exits along with the entrypoint.
+func sharedMountArgs(ctx context.Context, cfg vmconfig.VMConfig, deviceSuffix string) ([]string, string, error) {
+	var (
+		args      []string
+		initArgs  string
+		sharedMem bool
+	)
+
+	for i, m := range cfg.Mounts {
+		tag := vmconfig.MountTag(i)
+		switch m.Type {
+		case vmconfig.MountType9p:
+			fsdev := "local,id=" + tag + ",path=" + m.Source + ",security_model=none"
+			if m.ReadOnly {
+				fsdev += ",readonly=on"
+			}
+			args = append(args,
+				"-fsdev", fsdev,
+				"-device", "virtio-9p"+deviceSuffix+",fsdev="+tag+",mount_tag="+tag,
+			)
+		case vmconfig.MountTypeVirtiofs:
+			sock := filepath.Join("/tmp", "virtiofsd-"+tag+".sock")
+			if err := startVirtiofsd(ctx, sock, m.Source, cfg.Uid, cfg.Gid); err != nil {
+				return nil, "", err
+			}
+			dev := "vhost-user-fs-pci"
+			if deviceSuffix != "" {
+				dev = "vhost-user-fs" + deviceSuffix
+			}
+			args = append(args,
+				"-chardev", "socket,id="+tag+",path="+sock,
+				"-device", dev+",chardev="+tag+",tag="+tag,
+			)
+			sharedMem = true
+		default:
+			return nil, "", fmt.Errorf("unsupported mount type %q", m.Type)
+		}
+
+		initArgs += " --shared-mount=" + m.Type + ":" + tag + ":" + m.Target
+		if m.ReadOnly {
+			initArgs += ":ro"
+		}
+		initArgs += " "
+	}
+
+	// vhost-user devices need the guest memory to be shared with the backend.
+	if sharedMem {
+		args = append(args,
+			"-object", "memory-backend-memfd,id=mem,size="+cfg.Memory+",share=on",
+			"-machine", "memory-backend=mem",
+		)
+	}
+	return args, initArgs, nil
+}
+
+// startVirtiofsd starts virtiofsd for the passed in directory and waits for its socket.
+// The socket is owned by the passed in uid/gid so qemu can still connect to it after dropping privileges.
+func startVirtiofsd(ctx context.Context, sock, dir string, uid, gid int) error {
+	os.Remove(sock)
+
+	// The default namespace sandbox needs privileges to unshare and mount which the container does not have,
+	// chroot only needs CAP_SYS_CHROOT which docker grants by default.
+	cmd := exec.CommandContext(ctx, virtiofsdPath, "--socket-path="+sock, "-o", "source="+dir, "-o", "cache=auto", "-o", "sandbox=chroot")
+	cmd.Stderr = logrus.WithField("component", "virtiofsd").WriterLevel(logrus.DebugLevel)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Pdeathsig: syscall.SIGKILL,
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("error starting virtiofsd: %w", err)
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	for {
+		if _, err := os.Stat(sock); err == nil {
+			break
+		}
+		select {
+		case err := <-exited:
+			return fmt.Errorf("virtiofsd exited before creating its socket: %v", err)
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	return os.Chown(sock, uid, gid)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cpuguy83/qemu-micro-env/build/vmconfig"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	passtBin        = "/usr/bin/passt"
+	passtSocketPath = "/tmp/passt.sock"
+)
+
+// startPasst starts passt with the passed in ports mapped from the container to the VM.
+// The VM gets the container's address and reaches the outside through passt, so NET_ADMIN is not needed.
+// It returns the qemu netdev spec to connect to passt.
+func startPasst(ctx context.Context, arch string, ports []vmconfig.PortForward, uid, gid int) (string, error) {
+	os.Remove(passtSocketPath)
+
+	args := []string{
+		"--foreground",
+		"--socket", passtSocketPath,
+		"--runas", strconv.Itoa(uid) + ":" + strconv.Itoa(gid),
+	}
+	var tcp, udp []string
+	for _, p := range ports {
+		if p.Proto == vmconfig.ProtoUDP {
+			udp = append(udp, strconv.Itoa(p.GuestPort))
+		} else {
+			tcp = append(tcp, strconv.Itoa(p.GuestPort))
+		}
+	}
+	if len(tcp) > 0 {
+		args = append(args, "--tcp-ports", strings.Join(tcp, ","))
+	}
+	if len(udp) > 0 {
+		args = append(args, "--udp-ports", strings.Join(udp, ","))
+	}
+	if logrus.GetLevel() >= logrus.DebugLevel {
+		args = append(args, "--debug")
+	} else {
+		args = append(args, "--quiet")
+	}
+
+	cmd := exec.CommandContext(ctx, passtBin, args...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Pdeathsig: syscall.SIGKILL,
+	}
+	logrus.WithField("args", cmd.Args).Debug("Starting passt")
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("error starting passt: %w", err)
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	for {
+		if _, err := os.Stat(passtSocketPath); err == nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case err := <-exited:
+			return "", fmt.Errorf("passt exited before it was ready: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	go func() {
+		if err := <-exited; err != nil && ctx.Err() == nil {
+			logrus.WithError(err).Error("passt exited")
+		}
+	}()
+
+	if qemuHasNetdev(arch, "stream") {
+		return "stream,id=net0,server=off,addr.type=unix,addr.path=" + passtSocketPath, nil
+	}
+
+	// Older qemu has no stream netdev and cannot connect to a unix socket.
+	// The socket netdev uses the same framing as passt, so relay a tcp connection to the passt socket instead.
+	addr, err := relayToUnix(passtSocketPath)
+	if err != nil {
+		return "", fmt.Errorf("error setting up relay to passt: %w", err)
+	}
+	return "socket,id=net0,connect=" + addr, nil
+}
+
+// qemuHasNetdev checks if qemu supports the passed in netdev backend type.
+func qemuHasNetdev(arch, typ string) bool {
+	out, err := exec.Command("qemu-system-"+arch, "-netdev", "help").CombinedOutput()
+	if err != nil {
+		logrus.WithError(err).Debug(string(out))
+		return false
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// relayToUnix listens on a loopback tcp port and relays the first connection to it to the unix socket.
+// It returns the address of the listener.
+func relayToUnix(sock string) (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+
+	go func() {
+		// qemu only ever connects once.
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			logrus.WithError(err).Error("accept failed")
+			return
+		}
+		defer conn.Close()
+
+		remote, err := net.Dial("unix", sock)
+		if err != nil {
+			logrus.WithError(err).Error("dial failed")
+			return
+		}
+		defer remote.Close()
+
+		go io.Copy(remote, conn)
+		io.Copy(conn, remote)
+	}()
+
+	return l.Addr().String(), nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cpuguy83/qemu-micro-env/build/vmconfig"
+)
+
+// sshGuestPort is the guest port the entrypoint connects to the VM over ssh with.
+const sshGuestPort = 22
+
+// portForwarder tracks the ports forwarded to the VM so they can be changed while it is running.
+// Forwarded ports are published on the container address, only ports set when the VM is started can be published on the host by docker.
+type portForwarder struct {
+	net string
+	// guestIP is the address of the VM with tap networking.
+	guestIP net.IP
+	// mon is used to change qemu's hostfwd rules with user-mode networking.
+	mon *monitor
+
+	mu       sync.Mutex
+	forwards map[string]*activeForward
+}
+
+// activeForward is a port which is forwarded to the VM.
+type activeForward struct {
+	port vmconfig.PortForward
+	// localPort is the qemu hostfwd port the port is proxied to with user-mode networking.
+	localPort int
+	closer    io.Closer
+}
+
+func newPortForwarder(netMode string) *portForwarder {
+	return &portForwarder{net: netMode, forwards: make(map[string]*activeForward)}
+}
+
+// track records a port that was forwarded when the VM was started.
+func (f *portForwarder) track(p vmconfig.PortForward, localPort int, closer io.Closer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.forwards[p.ContainerPort()] = &activeForward{port: p, localPort: localPort, closer: closer}
+}
+
+// add forwards the guest port of the passed in spec and returns the address of the port on the container network
+// (see containerAddr), it is not published on the host.
+func (f *portForwarder) add(p vmconfig.PortForward) (string, error) {
+	if p.HostIP != "" || p.HostPort != 0 {
+		return "", fmt.Errorf("host ports can only be set when the VM is started, ports added to a running VM are published on the container address")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.forwards[p.ContainerPort()]; ok {
+		return "", fmt.Errorf("port %s is already forwarded", p.ContainerPort())
+	}
+
+	fwd := &activeForward{port: p}
+	switch f.net {
+	case vmconfig.NetUser:
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return "", err
+		}
+		fwd.localPort = l.Addr().(*net.TCPAddr).Port
+		l.Close()
+
+		if err := f.runMonitor(fmt.Sprintf("hostfwd_add net0 %s::%d-:%d", p.Proto, fwd.localPort, p.GuestPort)); err != nil {
+			return "", err
+		}
+
+		forward := vmconfig.ForwardPort
+		if p.Proto == vmconfig.ProtoUDP {
+			forward = vmconfig.ForwardUDPPort
+		}
+		fwd.closer, err = forward(p.GuestPort, fwd.localPort)
+		if err != nil {
+			f.runMonitor(fmt.Sprintf("hostfwd_remove net0 %s::%d", p.Proto, fwd.localPort))
+			return "", fmt.Errorf("error forwarding port: %w", err)
+		}
+	case vmconfig.NetTap:
+		if err := iptables(tapDNATRule("-A", f.guestIP, p)...); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("ports cannot be changed on a running VM with --net=%s", f.net)
+	}
+
+	f.forwards[p.ContainerPort()] = fwd
+	return containerAddr(p), nil
+}
+
+// remove stops forwarding the guest port of the passed in spec.
+func (f *portForwarder) remove(p vmconfig.PortForward) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fwd, ok := f.forwards[p.ContainerPort()]
+	if !ok {
+		return fmt.Errorf("port %s is not forwarded", p.ContainerPort())
+	}
+	if p.Proto == vmconfig.ProtoTCP && p.GuestPort == sshGuestPort {
+		return fmt.Errorf("port %s is used to connect to the VM over ssh and cannot be removed", p.ContainerPort())
+	}
+
+	switch f.net {
+	case vmconfig.NetUser:
+		if err := f.runMonitor(fmt.Sprintf("hostfwd_remove net0 %s::%d", p.Proto, fwd.localPort)); err != nil {
+			return err
+		}
+		if fwd.closer != nil {
+			fwd.closer.Close()
+		}
+	case vmconfig.NetTap:
+		if err := iptables(tapDNATRule("-D", f.guestIP, p)...); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("ports cannot be changed on a running VM with --net=%s", f.net)
+	}
+
+	delete(f.forwards, p.ContainerPort())
+	return nil
+}
+
+// list returns the forwarded ports along with their address on the container network, one per line.
+// Ports set when the VM was started are also published on the host by docker, their host address is not known
+// here (see docker port).
+func (f *portForwarder) list() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var lines []string
+	for _, fwd := range f.forwards {
+		lines = append(lines, fwd.port.ContainerPort()+" "+containerAddr(fwd.port))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// runMonitor runs a monitor command which prints nothing on success.
+func (f *portForwarder) runMonitor(cmd string) error {
+	if f.mon == nil {
+		return fmt.Errorf("qemu monitor is not available")
+	}
+	out, err := f.mon.Run(cmd)
+	if err != nil {
+		return err
+	}
+	// The first line is the echoed command.
+	if _, out, _ = strings.Cut(out, "\n"); strings.TrimSpace(out) != "" {
+		return fmt.Errorf("%s: %s", cmd, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// containerAddr returns the address of the port on the container network.
+// Docker adds the container's hostname to /etc/hosts with the container address.
+// This is only reachable from the machine the docker daemon runs on, e.g. not from the host with Docker Desktop.
+func containerAddr(p vmconfig.PortForward) string {
+	host := "0.0.0.0"
+	if name, err := os.Hostname(); err == nil {
+		if ips, err := net.LookupIP(name); err == nil {
+			for _, ip := range ips {
+				if ip.To4() != nil && !ip.IsLoopback() {
+					host = ip.String()
+					break
+				}
+			}
+		}
+	}
+	return net.JoinHostPort(host, strconv.Itoa(p.GuestPort)) + "/" + p.Proto
+}
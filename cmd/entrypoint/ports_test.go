@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/cpuguy83/qemu-micro-env/build/vmconfig"
+)
+
+// fakeMonitor speaks just enough of the qemu human monitor protocol to test the port forwarder.
+// Commands are echoed back, followed by the output from the handler and the prompt.
+func fakeMonitor(t *testing.T, handler func(cmd string) string) *monitor {
+	t.Helper()
+
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	go func() {
+		if _, err := server.Write([]byte("QEMU 6.2.0 monitor - type 'help' for more information\r\n(qemu) ")); err != nil {
+			return
+		}
+		scanner := bufio.NewScanner(server)
+		for scanner.Scan() {
+			cmd := scanner.Text()
+			if _, err := server.Write([]byte(cmd + "\r\n" + handler(cmd) + "(qemu) ")); err != nil {
+				return
+			}
+		}
+	}()
+
+	m := &monitor{conn: client, rdr: bufio.NewReader(client)}
+	if _, err := m.readPrompt(); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// freePort returns a port which is not in use on the loopback interface.
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestPortForwarder(t *testing.T) {
+	// Monitor commands are synchronous, so cmds is not accessed concurrently.
+	var cmds []string
+	f := newPortForwarder(vmconfig.NetUser)
+	f.mon = fakeMonitor(t, func(cmd string) string {
+		cmds = append(cmds, cmd)
+		if strings.HasPrefix(cmd, "hostfwd_remove net0 udp::") {
+			return "host forwarding rule not found\r\n"
+		}
+		return ""
+	})
+
+	f.track(vmconfig.PortForward{GuestPort: sshGuestPort, Proto: vmconfig.ProtoTCP}, 2222, nil)
+
+	port := freePort(t)
+	p := vmconfig.PortForward{GuestPort: port, Proto: vmconfig.ProtoTCP}
+	addr, err := f.add(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != containerAddr(p) {
+		t.Errorf("expected container address %s, got %s", containerAddr(p), addr)
+	}
+	localPort := f.forwards[p.ContainerPort()].localPort
+	if len(cmds) != 1 || cmds[0] != "hostfwd_add net0 tcp::"+strconv.Itoa(localPort)+"-:"+strconv.Itoa(port) {
+		t.Errorf("unexpected monitor commands: %v", cmds)
+	}
+
+	// The port is proxied to the qemu hostfwd port.
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatalf("port is not forwarded: %v", err)
+	}
+	conn.Close()
+
+	if _, err := f.add(p); err == nil {
+		t.Error("expected error adding a port twice")
+	}
+	if _, err := f.add(vmconfig.PortForward{HostPort: 8080, GuestPort: 8080, Proto: vmconfig.ProtoTCP}); err == nil {
+		t.Error("expected error adding a host port")
+	}
+
+	// Ports set when the VM is started are listed with their container address too.
+	ls := strings.Split(f.list(), "\n")
+	ssh := vmconfig.PortForward{GuestPort: sshGuestPort, Proto: vmconfig.ProtoTCP}
+	if len(ls) != 2 || ls[0] != "22/tcp "+containerAddr(ssh) || ls[1] != p.ContainerPort()+" "+addr {
+		t.Errorf("unexpected list: %v", ls)
+	}
+
+	if err := f.remove(vmconfig.PortForward{GuestPort: sshGuestPort, Proto: vmconfig.ProtoTCP}); err == nil {
+		t.Error("expected error removing the ssh port")
+	}
+	if err := f.remove(vmconfig.PortForward{GuestPort: 1, Proto: vmconfig.ProtoTCP}); err == nil {
+		t.Error("expected error removing a port which is not forwarded")
+	}
+
+	if err := f.remove(p); err != nil {
+		t.Fatal(err)
+	}
+	if cmds[len(cmds)-1] != "hostfwd_remove net0 tcp::"+strconv.Itoa(localPort) {
+		t.Errorf("unexpected monitor commands: %v", cmds)
+	}
+	if _, ok := f.forwards[p.ContainerPort()]; ok {
+		t.Error("port is still tracked after removing it")
+	}
+	if l, err := net.Listen("tcp", "0.0.0.0:"+strconv.Itoa(port)); err != nil {
+		t.Errorf("port proxy was not closed: %v", err)
+	} else {
+		l.Close()
+	}
+
+	// Monitor errors are returned and the port stays forwarded.
+	udp := vmconfig.PortForward{GuestPort: 53, Proto: vmconfig.ProtoUDP}
+	f.track(udp, 5353, nil)
+	if err := f.remove(udp); err == nil || !strings.Contains(err.Error(), "host forwarding rule not found") {
+		t.Errorf("expected monitor error, got: %v", err)
+	}
+	if _, ok := f.forwards[udp.ContainerPort()]; !ok {
+		t.Error("port should still be tracked when removing it fails")
+	}
+
+	f = newPortForwarder(vmconfig.NetPasst)
+	if _, err := f.add(vmconfig.PortForward{GuestPort: 8080, Proto: vmconfig.ProtoTCP}); err == nil {
+		t.Error("expected error changing ports with passt networking")
+	}
+}
+
+func TestContainerAddr(t *testing.T) {
+	addr := containerAddr(vmconfig.PortForward{HostIP: "127.0.0.1", HostPort: 5353, GuestPort: 53, Proto: vmconfig.ProtoUDP})
+	hostPort, proto, _ := strings.Cut(addr, "/")
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The host port is published by docker, the container network only has the guest port.
+	if port != "53" || proto != "udp" {
+		t.Errorf("unexpected address: %s", addr)
+	}
+
+	// Docker maps the container's hostname to the container address in /etc/hosts.
+	ip := net.ParseIP(host)
+	if ip == nil || ip.To4() == nil || ip.IsLoopback() {
+		t.Fatalf("expected a non-loopback IPv4 address, got %s", host)
+	}
+	if ip.IsUnspecified() {
+		return
+	}
+	name, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ips, err := net.LookupIP(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hostIP := range ips {
+		if hostIP.Equal(ip) {
+			return
+		}
+	}
+	t.Errorf("%s is not an address of %s: %v", host, name, ips)
+}
+
+func TestControllerHandle(t *testing.T) {
+	f := newPortForwarder(vmconfig.NetUser)
+	f.track(vmconfig.PortForward{GuestPort: sshGuestPort, Proto: vmconfig.ProtoTCP}, 2222, nil)
+	f.track(vmconfig.PortForward{GuestPort: 53, Proto: vmconfig.ProtoUDP}, 5353, nil)
+	c := &controller{ports: f}
+
+	out, err := c.handle(context.Background(), strings.NewReader("port-ls\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls := strings.Split(out, "\n")
+	if len(ls) != 2 || !strings.HasPrefix(ls[0], "22/tcp ") || !strings.HasPrefix(ls[1], "53/udp ") {
+		t.Errorf("unexpected output: %q", out)
+	}
+
+	for _, req := range []string{
+		"\n",
+		"nope\n",
+		"port-add\n",
+		"port-add nope\n",
+		"port-rm 22\n",
+		"powerdown\n",
+		"save foo\n",
+		"port-ls",
+	} {
+		if _, err := c.handle(context.Background(), strings.NewReader(req)); err == nil {
+			t.Errorf("expected error for request %q", req)
+		}
+	}
+}
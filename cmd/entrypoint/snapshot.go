@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/cpuguy83/qemu-micro-env/build/vmconfig"
+)
+
+// doSnapshot manages internal snapshots of the persisted root disk.
+// qemu holds a lock on the disk while the VM is running, so this only works for a stopped VM.
+func doSnapshot(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: snapshot save|restore|list [name]")
+	}
+
+	p := filepath.Join(stateDir, vmconfig.PersistedRootDisk)
+	if _, err := os.Stat(p); err != nil {
+		return fmt.Errorf("no persisted root disk found, run with --persist first: %w", err)
+	}
+
+	var qemuArgs []string
+	switch args[0] {
+	case "save", "restore":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: snapshot %s <name>", args[0])
+		}
+		op := "-c"
+		if args[0] == "restore" {
+			op = "-a"
+		}
+		qemuArgs = []string{"snapshot", op, args[1], p}
+	case "list":
+		qemuArgs = []string{"snapshot", "-l", p}
+	default:
+		return fmt.Errorf("unknown snapshot command: %s", args[0])
+	}
+
+	cmd := exec.Command("qemu-img", qemuArgs...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error running qemu-img %s: %w", args[0], err)
+	}
+	return nil
+}
+
+// rootfsSnapshotPath is where the root disk of a live snapshot is copied to when restoring it.
+// The snapshot itself is left untouched so it can be restored again.
+const rootfsSnapshotPath = "/tmp/rootfs-snapshot.qcow2"
+
+// loadSnapshot loads the VM config from a live snapshot.
+// The devices of the VM must be the same as the saved VM, so the saved config replaces the passed in one,
+// except for the settings that only affect how the VM is accessed.
+// It returns the snapshot dir.
+func loadSnapshot(cfg *vmconfig.VMConfig) (string, error) {
+	if err := vmconfig.ValidateSnapshotName(cfg.FromSnapshot); err != nil {
+		return "", err
+	}
+	if cfg.Persist {
+		return "", fmt.Errorf("--persist cannot be used with --from-snapshot")
+	}
+
+	dir := filepath.Join(stateDir, vmconfig.SnapshotsDir, cfg.FromSnapshot)
+	dt, err := os.ReadFile(filepath.Join(dir, vmconfig.SnapshotFlagsFile))
+	if err != nil {
+		return "", fmt.Errorf("error reading snapshot %q: %w", cfg.FromSnapshot, err)
+	}
+
+	var saved vmconfig.VMConfig
+	set := flag.NewFlagSet("snapshot", flag.ContinueOnError)
+	vmconfig.AddVMFlags(set, &saved)
+	if err := set.Parse(strings.Split(strings.TrimSpace(string(dt)), "\n")); err != nil {
+		return "", fmt.Errorf("error parsing flags of snapshot %q: %w", cfg.FromSnapshot, err)
+	}
+
+	saved.Uid = cfg.Uid
+	saved.Gid = cfg.Gid
+	saved.PortForwards = cfg.PortForwards
+	// Only the NICs are part of the VM state, the network backend can differ from the one the snapshot was taken with.
+	saved.Net = cfg.Net
+	saved.SocketForwards = cfg.SocketForwards
+	saved.DebugConsole = cfg.DebugConsole
+	saved.RequireKVM = cfg.RequireKVM
+	saved.FromSnapshot = cfg.FromSnapshot
+	// The snapshot is restored from a copy of its root disk, not the persisted one.
+	saved.Persist = false
+	*cfg = saved
+
+	return dir, nil
+}
@@ -16,6 +16,7 @@ import (
 	"time"
 
 	"github.com/cpuguy83/pipes"
+	"github.com/cpuguy83/qemu-micro-env/build/vmconfig"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/sys/unix"
@@ -39,53 +40,41 @@ func generateKeys() ([]byte, []byte, error) {
 	return pub, pem, nil
 }
 
-func doSSH(ctx context.Context, sockDir string, port string, uid, gid int, forwards []string) error {
-	logrus.Debug("Preparing SSH")
-	fifoPath := filepath.Join(sockDir, "authorized_keys")
+// guestSSH runs commands in the VM over ssh, using the keys loaded in the ssh-agent.
+type guestSSH struct {
+	host   string
+	port   string
+	sockKV string
+}
 
-	if err := mkdirAs(sockDir, 0700, uid, gid); err != nil {
-		return fmt.Errorf("error creating socket directory: %w", err)
-	}
+// Command returns a command which runs the passed in shell command in the VM.
+func (g *guestSSH) Command(ctx context.Context, cmd string) *exec.Cmd {
+	c := exec.CommandContext(ctx,
+		"/usr/bin/ssh",
+		"-T",
+		"-o", "BatchMode=yes",
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "LogLevel=ERROR",
+		g.host, "-p", g.port,
+		cmd,
+	)
+	c.Env = append(c.Env, g.sockKV)
+	return c
+}
 
-	ch, err := pipes.AsyncOpenFifo(fifoPath, os.O_WRONLY|os.O_CREATE, 0600)
-	if err != nil {
-		return fmt.Errorf("error opening fifo: %s: %w", fifoPath, err)
-	}
+// doSSH sets up ssh access to the VM using the passed in keys.
+// When sendKey is set the public key is sent to the VM over the authorized_keys pipe.
+// The returned guestSSH can be used to run commands in the VM.
+func doSSH(ctx context.Context, sockDir string, host, port string, pub, priv []byte, sendKey bool, uid, gid int, forwards []string) (*guestSSH, error) {
+	logrus.Debug("Preparing SSH")
 
-	logrus.Debug("Generating keys")
-	pub, priv, err := generateKeys()
-	if err != nil {
-		return err
+	if err := mkdirAs(sockDir, 0700, uid, gid); err != nil {
+		return nil, fmt.Errorf("error creating socket directory: %w", err)
 	}
 
-	logrus.Debug("Writing authorized keys")
-	chAuth := make(chan error, 1)
-	go func() {
-		defer close(chAuth)
-		chAuth <- func() error {
-			logrus.Info("Waiting for fifo to be ready...")
-			select {
-			case <-ctx.Done():
-				return ctx.Err()
-			case result := <-ch:
-				if result.Err != nil {
-					return fmt.Errorf("error opening fifo: %w", result.Err)
-				}
-				defer result.W.Close()
-				if _, err := result.W.Write(append(pub, '\n')); err != nil {
-					return fmt.Errorf("error writing public key to authorized_keys: %w", err)
-				}
-				logrus.Debug("Public key written to authorized_keys fifo")
-			}
-			return nil
-		}()
-	}()
-
-	select {
-	case <-ctx.Done():
-	case err := <-chAuth:
-		if err != nil {
-			return err
+	if sendKey {
+		if err := sendAuthorizedKey(ctx, filepath.Join(sockDir, "authorized_keys"), pub); err != nil {
+			return nil, err
 		}
 	}
 
@@ -102,20 +91,20 @@ func doSSH(ctx context.Context, sockDir string, port string, uid, gid int, forwa
 
 	out, err := agentCmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("error starting ssh-agent: %w: %s", err, out)
+		return nil, fmt.Errorf("error starting ssh-agent: %w: %s", err, out)
 	}
 	cmd := exec.Command("/bin/sh", "-c", "eval \""+string(out)+"\" && ssh-add -")
 
 	cmd.Stdin = bytes.NewReader(priv)
 	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("error adding private key to ssh-agent: %s: %w", out, err)
+		return nil, fmt.Errorf("error adding private key to ssh-agent: %s: %w", out, err)
 	}
 
 	logrus.Debug(string(out))
 
 	sockKV, _, found := strings.Cut(string(out), ";")
 	if !found {
-		return fmt.Errorf("error parsing ssh-agent output: %s", out)
+		return nil, fmt.Errorf("error parsing ssh-agent output: %s", out)
 	}
 
 	for _, f := range forwards {
@@ -136,12 +125,12 @@ func doSSH(ctx context.Context, sockDir string, port string, uid, gid int, forwa
 						"-o", "StrictHostKeyChecking=no",
 						"-o", "ExitOnForwardFailure=yes",
 						"-L", local+":"+f,
-						"127.0.0.1", "-p", port,
+						host, "-p", port,
 					)
 					cmd.Env = append(cmd.Env, sockKV)
 
 					if out, err := cmd.CombinedOutput(); err != nil {
-						if strings.Contains(string(out), "Connection refused") || strings.Contains(string(out), "Connection reset by peer") {
+						if strings.Contains(string(out), "Connection refused") || strings.Contains(string(out), "Connection reset by peer") || strings.Contains(string(out), "No route to host") {
 							if i == 100 {
 								logrus.WithError(err).Warn(string(out))
 								i = 0
@@ -164,6 +153,79 @@ func doSSH(ctx context.Context, sockDir string, port string, uid, gid int, forwa
 		}(f)
 	}
 
+	return &guestSSH{host: host, port: port, sockKV: sockKV}, nil
+}
+
+// waitReady runs the readiness check in the VM until it succeeds and then creates the ready file.
+func waitReady(ctx context.Context, g *guestSSH, sockDir, check string, uid, gid int) error {
+	logrus.WithField("check", check).Debug("Waiting for the VM to be ready")
+	for {
+		out, err := g.Command(ctx, check).CombinedOutput()
+		if err == nil {
+			break
+		}
+		logrus.WithError(err).Debug(strings.TrimSpace(string(out)))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+
+	p := filepath.Join(sockDir, vmconfig.ReadyFile)
+	if err := os.WriteFile(p, nil, 0644); err != nil {
+		return fmt.Errorf("error writing ready file: %w", err)
+	}
+	if err := os.Chown(p, uid, gid); err != nil {
+		return fmt.Errorf("error chowning ready file: %w", err)
+	}
+	logrus.Info("VM is ready")
+	return nil
+}
+
+// sendAuthorizedKey writes the public key, along with a time sync, to the pipe that is read by init in the VM.
+func sendAuthorizedKey(ctx context.Context, fifoPath string, pub []byte) error {
+	ch, err := pipes.AsyncOpenFifo(fifoPath, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening fifo: %s: %w", fifoPath, err)
+	}
+
+	logrus.Debug("Writing authorized keys")
+	chAuth := make(chan error, 1)
+	go func() {
+		defer close(chAuth)
+		chAuth <- func() error {
+			logrus.Info("Waiting for fifo to be ready...")
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case result := <-ch:
+				if result.Err != nil {
+					return fmt.Errorf("error opening fifo: %w", result.Err)
+				}
+				defer result.W.Close()
+				// Sync the guest clock along with the key, this matters for VMs restored from a snapshot
+				// since their clock continues from when the snapshot was taken.
+				if _, err := fmt.Fprintf(result.W, "@time %d\n", time.Now().UnixNano()); err != nil {
+					return fmt.Errorf("error writing time sync to authorized_keys: %w", err)
+				}
+				if _, err := result.W.Write(append(pub, '\n')); err != nil {
+					return fmt.Errorf("error writing public key to authorized_keys: %w", err)
+				}
+				logrus.Debug("Public key written to authorized_keys fifo")
+			}
+			return nil
+		}()
+	}()
+
+	select {
+	case <-ctx.Done():
+	case err := <-chAuth:
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cpuguy83/qemu-micro-env/build/vmconfig"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv4/server4"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// tapFallbackDNS is used when the container only has loopback nameservers (like docker's embedded DNS), which the VM cannot reach.
+	// This matches what docker falls back to.
+	tapFallbackDNS = "8.8.8.8"
+
+	ipForwardPath = "/proc/sys/net/ipv4/ip_forward"
+)
+
+// tapAddrs returns the address of the bridge and of the VM on the network of the NIC.
+func tapAddrs(nic vmconfig.NIC) (bridge, guest net.IP, subnet *net.IPNet, _ error) {
+	bridge, subnet, err := nic.SubnetIP(1)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	guest, _, err = nic.SubnetIP(2)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return bridge, guest, subnet, nil
+}
+
+// setupTapNetwork creates a bridge with a tap device for each NIC of the VM, serves DHCP to the VM on the bridges,
+// and sets up NAT for outbound traffic and for the forwarded ports, which go to the first NIC.
+// It returns the qemu netdev spec for each NIC.
+func setupTapNetwork(ctx context.Context, nics []vmconfig.NIC, ports []vmconfig.PortForward, uid, gid int) ([]string, error) {
+	if err := enableIPForward(); err != nil {
+		return nil, err
+	}
+
+	dns := tapNameservers()
+	var netdevs []string
+	for i, nic := range nics {
+		bridgeIP, guestIP, subnet, err := tapAddrs(nic)
+		if err != nil {
+			return nil, err
+		}
+		brName := "br" + strconv.Itoa(i)
+		tapName := "tap" + strconv.Itoa(i)
+
+		br := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: brName}}
+		if err := netlink.LinkAdd(br); err != nil {
+			return nil, fmt.Errorf("error creating bridge: %w", err)
+		}
+		if err := netlink.AddrAdd(br, &netlink.Addr{IPNet: &net.IPNet{IP: bridgeIP, Mask: subnet.Mask}}); err != nil {
+			return nil, fmt.Errorf("error adding address to bridge: %w", err)
+		}
+
+		// qemu drops privileges with -runas, so the tap device is owned by the VM user.
+		tap := &netlink.Tuntap{
+			LinkAttrs: netlink.LinkAttrs{Name: tapName},
+			Mode:      netlink.TUNTAP_MODE_TAP,
+			Flags:     netlink.TUNTAP_DEFAULTS | netlink.TUNTAP_NO_PI,
+			Owner:     uint32(uid),
+			Group:     uint32(gid),
+		}
+		if err := netlink.LinkAdd(tap); err != nil {
+			return nil, fmt.Errorf("error creating tap device: %w", err)
+		}
+		if err := netlink.LinkSetMaster(tap, br); err != nil {
+			return nil, fmt.Errorf("error attaching tap device to bridge: %w", err)
+		}
+
+		for _, l := range []netlink.Link{br, tap} {
+			if err := netlink.LinkSetUp(l); err != nil {
+				return nil, fmt.Errorf("error setting link %q to up state: %w", l.Attrs().Name, err)
+			}
+		}
+
+		rules := [][]string{
+			{"-t", "nat", "-A", "POSTROUTING", "-s", subnet.String(), "!", "-o", brName, "-j", "MASQUERADE"},
+		}
+		if i == 0 {
+			for _, p := range ports {
+				rules = append(rules, tapDNATRule("-A", guestIP, p))
+			}
+		}
+		for _, r := range rules {
+			if err := iptables(r...); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := serveDHCP(ctx, brName, bridgeIP, guestIP, subnet.Mask, dns); err != nil {
+			return nil, err
+		}
+
+		netdev := "tap,id=" + nic.ID(i) + ",ifname=" + tapName + ",script=no,downscript=no"
+		if _, err := os.Stat("/dev/vhost-net"); err == nil {
+			netdev += ",vhost=on"
+		}
+		netdevs = append(netdevs, netdev)
+	}
+	return netdevs, nil
+}
+
+// tapDNATRule returns the iptables arguments to add (-A) or delete (-D) the rule which maps the port in the container to the VM.
+// Ports are only mapped to the first NIC.
+func tapDNATRule(action string, guestIP net.IP, p vmconfig.PortForward) []string {
+	port := strconv.Itoa(p.GuestPort)
+	return []string{"-t", "nat", action, "PREROUTING", "!", "-i", "br0", "-p", p.Proto, "--dport", port, "-j", "DNAT", "--to-destination", guestIP.String() + ":" + port}
+}
+
+func iptables(args ...string) error {
+	if out, err := exec.Command("iptables", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("error running iptables %q: %w: %s", strings.Join(args, " "), err, out)
+	}
+	return nil
+}
+
+// enableIPForward turns on IPv4 forwarding in the container.
+// /proc/sys is read-only in unprivileged containers, so the runner normally sets this when creating the container.
+func enableIPForward() error {
+	dt, err := os.ReadFile(ipForwardPath)
+	if err == nil && strings.TrimSpace(string(dt)) == "1" {
+		return nil
+	}
+	if err := os.WriteFile(ipForwardPath, []byte("1\n"), 0644); err != nil {
+		return fmt.Errorf("error enabling ip forwarding: %w", err)
+	}
+	return nil
+}
+
+// serveDHCP answers DHCP requests from the VM on the bridge.
+// There is only ever one guest on the bridge, so it always gets the same address.
+func serveDHCP(ctx context.Context, bridge string, bridgeIP, guestIP net.IP, mask net.IPMask, dns []net.IP) error {
+	handler := func(conn net.PacketConn, peer net.Addr, m *dhcpv4.DHCPv4) {
+		var typ dhcpv4.MessageType
+		switch m.MessageType() {
+		case dhcpv4.MessageTypeDiscover:
+			typ = dhcpv4.MessageTypeOffer
+		case dhcpv4.MessageTypeRequest:
+			typ = dhcpv4.MessageTypeAck
+		default:
+			return
+		}
+
+		reply, err := dhcpv4.NewReplyFromRequest(m,
+			dhcpv4.WithMessageType(typ),
+			dhcpv4.WithYourIP(guestIP),
+			dhcpv4.WithServerIP(bridgeIP),
+			dhcpv4.WithOption(dhcpv4.OptServerIdentifier(bridgeIP)),
+			dhcpv4.WithNetmask(mask),
+			dhcpv4.WithRouter(bridgeIP),
+			dhcpv4.WithDNS(dns...),
+			dhcpv4.WithLeaseTime(uint32((24 * time.Hour).Seconds())),
+		)
+		if err != nil {
+			logrus.WithError(err).Error("error creating DHCP reply")
+			return
+		}
+		if _, err := conn.WriteTo(reply.ToBytes(), peer); err != nil {
+			logrus.WithError(err).Error("error sending DHCP reply")
+		}
+	}
+
+	srv, err := server4.NewServer(bridge, &net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ServerPort}, handler)
+	if err != nil {
+		return fmt.Errorf("error creating DHCP server: %w", err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		if err := srv.Serve(); err != nil && ctx.Err() == nil {
+			logrus.WithError(err).Error("DHCP server failed")
+		}
+	}()
+	return nil
+}
+
+// tapNameservers returns the nameservers from the container's resolv.conf which the VM can reach.
+func tapNameservers() []net.IP {
+	var out []net.IP
+
+	f, err := os.Open("/etc/resolv.conf")
+	if err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 2 || fields[0] != "nameserver" {
+				continue
+			}
+			ip := net.ParseIP(fields[1])
+			if ip == nil || ip.To4() == nil || ip.IsLoopback() {
+				continue
+			}
+			out = append(out, ip)
+		}
+	}
+
+	if len(out) == 0 {
+		out = append(out, net.ParseIP(tapFallbackDNS))
+	}
+	return out
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const kernelDiskMount = "/run/kernel"
+
+// findDiskBySerial returns the device path for the block device with the passed in serial.
+// The serial is set by the entrypoint when adding the device to the VM.
+func findDiskBySerial(serial string) (string, error) {
+	entries, err := os.ReadDir("/sys/block")
+	if err != nil {
+		return "", fmt.Errorf("error reading block devices: %w", err)
+	}
+
+	for _, e := range entries {
+		dt, err := os.ReadFile(filepath.Join("/sys/block", e.Name(), "serial"))
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(string(dt)) == serial {
+			return filepath.Join("/dev", e.Name()), nil
+		}
+	}
+	return "", fmt.Errorf("no block device found with serial %q", serial)
+}
+
+// mountKernelDisk mounts the disk holding the kernel modules, image, and config.
+// These are made available at /lib/modules and /boot respectively.
+func mountKernelDisk(serial string) error {
+	dev, err := findDiskBySerial(serial)
+	if err != nil {
+		return err
+	}
+
+	logrus.WithField("device", dev).Debug("mounting kernel disk")
+	if err := mount(dev, kernelDiskMount, "ext4", unix.MS_RDONLY, ""); err != nil {
+		return fmt.Errorf("error mounting kernel disk: %w", err)
+	}
+	return bindKernelDisk()
+}
+
+// bindKernelDisk bind mounts the kernel disk content into the root filesystem.
+func bindKernelDisk() error {
+	for _, p := range []string{"/lib/modules", "/boot"} {
+		src := filepath.Join(kernelDiskMount, p)
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+		if err := bindMount(src, p, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebindKernelDisk binds the kernel disk content into the root overlay after it is set up.
+func rebindKernelDisk() error {
+	mounted, err := isMountPoint(kernelDiskMount)
+	if err != nil {
+		return fmt.Errorf("error checking kernel disk mount: %w", err)
+	}
+	if !mounted {
+		return fmt.Errorf("kernel disk is not mounted at %s in the root overlay", kernelDiskMount)
+	}
+	return bindKernelDisk()
+}
+
+// isMountPoint checks if the path is a mount point by comparing its device with the one of its parent.
+func isMountPoint(p string) (bool, error) {
+	var st, parent unix.Stat_t
+	if err := unix.Lstat(p, &st); err != nil {
+		if errors.Is(err, unix.ENOENT) {
+			return false, nil
+		}
+		return false, err
+	}
+	if err := unix.Lstat(filepath.Dir(p), &parent); err != nil {
+		return false, err
+	}
+	return st.Dev != parent.Dev, nil
+}
+
+func bindMount(source, target string, readonly bool) error {
+	if err := mount(source, target, "", unix.MS_BIND, ""); err != nil {
+		return err
+	}
+	if !readonly {
+		return nil
+	}
+	if err := unix.Mount("", target, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY, ""); err != nil {
+		return fmt.Errorf("error remounting %s read-only: %w", target, err)
+	}
+	return nil
+}
+
+// stringListFlag is a flag that can be specified multiple times.
+type stringListFlag []string
+
+func (f *stringListFlag) String() string {
+	return fmt.Sprint(*f)
+}
+
+func (f *stringListFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// mountDataDisk mounts a persistent data disk, spec is in the form of <serial>:<path>.
+// The disk is formatted as ext4 the first time it is used.
+func mountDataDisk(spec string) error {
+	serial, target, ok := strings.Cut(spec, ":")
+	if !ok {
+		return fmt.Errorf("invalid data disk spec %q", spec)
+	}
+
+	dev, err := findDiskBySerial(serial)
+	if err != nil {
+		return err
+	}
+
+	empty, err := isEmptyDisk(dev)
+	if err != nil {
+		return err
+	}
+	if empty {
+		logrus.WithField("device", dev).WithField("serial", serial).Info("formatting data disk")
+		if out, err := exec.Command("mkfs.ext4", "-q", "-L", serial, dev).CombinedOutput(); err != nil {
+			return fmt.Errorf("error formatting data disk %s: %w: %s", serial, err, string(out))
+		}
+	}
+
+	logrus.WithField("device", dev).WithField("target", target).Debug("mounting data disk")
+	if err := mount(dev, target, "ext4", 0, ""); err != nil {
+		return fmt.Errorf("error mounting data disk %s: %w", serial, err)
+	}
+	return nil
+}
+
+// isEmptyDisk checks if the start of the disk, where filesystem superblocks live, is all zeros.
+// New data disks are created sparse so this is the case until they are formatted.
+func isEmptyDisk(dev string) (bool, error) {
+	f, err := os.Open(dev)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, 64*1024)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return false, fmt.Errorf("error reading %s: %w", dev, err)
+	}
+	return bytes.Count(buf[:n], []byte{0}) == n, nil
+}
+
+const binDiskMount = "/run/bin-disk"
+
+// mountBinDisk mounts the disk with binaries injected by the host and bind mounts each binary over the one found in
+// $PATH, or into /usr/local/bin when it is not installed in the rootfs.
+func mountBinDisk(serial string) error {
+	dev, err := findDiskBySerial(serial)
+	if err != nil {
+		return err
+	}
+
+	if err := mount(dev, binDiskMount, "ext4", unix.MS_RDONLY, ""); err != nil {
+		return fmt.Errorf("error mounting binaries disk: %w", err)
+	}
+
+	entries, err := os.ReadDir(binDiskMount)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+
+		target, err := exec.LookPath(e.Name())
+		if err != nil {
+			target = filepath.Join("/usr/local/bin", e.Name())
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.WriteFile(target, nil, 0755); err != nil {
+				return fmt.Errorf("error creating mount point for %s: %w", e.Name(), err)
+			}
+		}
+		// Resolve symlinks so the bind mount does not replace the link.
+		if p, err := filepath.EvalSymlinks(target); err == nil {
+			target = p
+		}
+
+		logrus.WithField("binary", e.Name()).WithField("target", target).Info("using injected binary")
+		if err := bindMount(filepath.Join(binDiskMount, e.Name()), target, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
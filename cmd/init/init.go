@@ -34,6 +34,15 @@ func main() {
 	debugConsole := flag.Bool("debug-console", false, "Get shell before init is run")
 	debug := flag.Bool("debug", false, "Get shell before init is run")
 	authorizedKeysPipe := flag.String("authorized-keys-pipe", "/dev/virtio-ports/authorized_keys", "Pipe to read authorized keys from")
+	kernelDisk := flag.String("kernel-disk", "", "Serial of the disk holding the kernel modules")
+	rootOverlay := flag.String("root-overlay", "", "Writable layer to put over a read-only root (tmpfs or disk:<serial>)")
+	binDisk := flag.String("bin-disk", "", "Serial of the disk holding binaries to use instead of the ones in the rootfs")
+	guestUserSpec := flag.String("guest-user", "", "Non-root user to create (<name>:<uid>:<gid>)")
+	guestSudo := flag.Bool("guest-sudo", false, "Give the guest user passwordless sudo")
+	primaryMAC := flag.String("primary-mac", "", "MAC address of the NIC to use for the default route and DNS, defaults to the first NIC")
+	var dataDisks, sharedMounts stringListFlag
+	flag.Var(&dataDisks, "data-disk", "Persistent disk to mount (<serial>:<path>), can be specified multiple times")
+	flag.Var(&sharedMounts, "shared-mount", "Host directory to mount (<virtiofs|9p>:<tag>:<path>[:ro]), can be specified multiple times")
 
 	// remove "-" from begining of args passed by the kernel
 	if len(os.Args) > 1 {
@@ -65,21 +74,71 @@ func main() {
 		return
 	}
 
+	os.Setenv("PATH", "/bin:/sbin:/usr/bin:/usr/sbin:/usr/local/bin:/usr/local/sbin")
+	os.Setenv("HOME", "/root")
+
+	logrus.Info("init: " + strings.Join(os.Args, " "))
+
+	// The kernel disk is mounted before the root overlay is setup since the overlay module may be on it.
+	if *kernelDisk != "" {
+		if err := mountKernelDisk(*kernelDisk); err != nil {
+			panic(err)
+		}
+	}
+
+	if *rootOverlay != "" {
+		if err := setupRootOverlay(*rootOverlay); err != nil {
+			panic(err)
+		}
+		if *kernelDisk != "" {
+			if err := rebindKernelDisk(); err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	for _, d := range dataDisks {
+		if err := mountDataDisk(d); err != nil {
+			panic(err)
+		}
+	}
+
+	for _, m := range sharedMounts {
+		if err := mountShared(m); err != nil {
+			panic(err)
+		}
+	}
+
+	if *binDisk != "" {
+		if err := mountBinDisk(*binDisk); err != nil {
+			panic(err)
+		}
+	}
+
 	if data, err := os.ReadFile("/etc/resolv.conf"); err != nil || len(data) == 0 {
 		if err := os.WriteFile("/etc/resolv.conf", []byte("nameserver 1.1.1.1"), 0644); err != nil {
 			panic(err)
 		}
 	}
 
-	os.Setenv("PATH", "/bin:/sbin:/usr/bin:/usr/sbin:/usr/local/bin:/usr/local/sbin")
-	os.Setenv("HOME", "/root")
 	pwd, err := os.Getwd()
 	if err != nil {
 		panic(err)
 	}
 	os.Setenv("PWD", pwd)
 
-	logrus.Info("init: " + strings.Join(os.Args, " "))
+	var guest *guestUser
+	if *guestUserSpec != "" {
+		guest, err = parseGuestUser(*guestUserSpec, *guestSudo)
+		if err != nil {
+			panic(err)
+		}
+		// The VM is still usable as root, so this is not fatal.
+		if err := setupGuestUser(guest); err != nil {
+			logrus.WithError(err).Error("error setting up guest user")
+			guest = nil
+		}
+	}
 
 	if *debugConsole {
 		cmd := exec.Command("/bin/bash")
@@ -122,7 +181,7 @@ func main() {
 		args = flag.Args()[1:]
 	}
 
-	if err := setupNetwork(); err != nil {
+	if err := setupNetwork(*primaryMAC); err != nil {
 		panic(err)
 	}
 
@@ -137,7 +196,7 @@ func main() {
 
 	go reap()
 	ssh()
-	if err := setupSSHKeys(*authorizedKeysPipe); err != nil {
+	if err := setupSSHKeys(*authorizedKeysPipe, guest); err != nil {
 		panic(err)
 	}
 
@@ -145,9 +204,51 @@ func main() {
 
 	logrus.Debug("starting command")
 
-	if err := cmd.Run(); err != nil {
+	if err := cmd.Start(); err != nil {
 		panic(err)
 	}
+	stopping := handleShutdown(cmd)
+	err = cmd.Wait()
+	select {
+	case <-stopping:
+		stopVM()
+	default:
+	}
+	if err != nil {
+		panic(err)
+	}
+}
+
+// shutdownTimeout is how long the command gets to exit on shutdown before the VM is stopped anyway.
+const shutdownTimeout = 30 * time.Second
+
+// handleShutdown stops the command and then the VM when init gets SIGTERM, which is how the runner powers down the VM.
+// The returned channel is closed once shutdown has started.
+func handleShutdown(cmd *exec.Cmd) <-chan struct{} {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, unix.SIGTERM)
+
+	stopping := make(chan struct{})
+	go func() {
+		<-ch
+		close(stopping)
+		logrus.Info("shutting down")
+		if err := cmd.Process.Signal(unix.SIGTERM); err != nil {
+			logrus.WithError(err).Warn("error stopping command")
+		}
+		time.AfterFunc(shutdownTimeout, func() {
+			logrus.Warn("command did not exit in time, stopping the VM")
+			stopVM()
+		})
+	}()
+	return stopping
+}
+
+// stopVM syncs the filesystems and stops the VM.
+// The VM has no ACPI to power off with, so it is reset instead, which stops qemu since it runs with -no-reboot.
+func stopVM() {
+	unix.Sync()
+	unix.Reboot(unix.LINUX_REBOOT_CMD_RESTART)
 }
 
 func mountCgroupV1() {
@@ -239,39 +340,102 @@ func ssh() {
 	}
 }
 
-func setupSSHKeys(pipe string) error {
+// setupSSHKeys waits for the first authorized key from the host.
+// The channel is kept open afterwards since a VM restored from a snapshot gets sent fresh keys and a time sync.
+// The keys are written for root and, if set, the guest user.
+func setupSSHKeys(pipe string, guest *guestUser) error {
 	f, err := os.OpenFile(pipe, os.O_RDONLY, 0)
 	if err != nil {
 		return fmt.Errorf("error opening ssh key: %w", err)
 	}
 
 	rdr := bufio.NewReader(f)
-	var (
-		line []byte
-	)
 
+	logrus.Info("waiting for ssh key")
 	for {
-		logrus.Info("waiting for ssh key")
-		line, err = rdr.ReadBytes('\n')
+		isKey, err := handleHostMessage(rdr, guest)
 		if err != nil {
-			if err == io.EOF {
-				time.Sleep(100 * time.Millisecond)
-				continue
+			f.Close()
+			return err
+		}
+		if isKey {
+			break
+		}
+	}
+
+	go func() {
+		defer f.Close()
+		for {
+			if _, err := handleHostMessage(rdr, guest); err != nil {
+				logrus.WithError(err).Error("error reading message from host")
+				return
 			}
-			return fmt.Errorf("error reading ssh key: %w", err)
 		}
-		break
+	}()
+	return nil
+}
+
+// handleHostMessage handles a single line sent by the host.
+// "@time <unix nanoseconds>" sets the system clock, anything else is an authorized key.
+// It returns true when an authorized key was written.
+func handleHostMessage(rdr *bufio.Reader, guest *guestUser) (bool, error) {
+	line, err := readHostLine(rdr)
+	if err != nil {
+		return false, fmt.Errorf("error reading ssh key: %w", err)
+	}
+
+	msg := strings.TrimSpace(string(line))
+	if msg == "" {
+		return false, nil
+	}
+
+	if v, ok := strings.CutPrefix(msg, "@time "); ok {
+		ns, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			logrus.WithError(err).Warn("invalid time sync message")
+			return false, nil
+		}
+		tv := unix.NsecToTimeval(ns)
+		if err := unix.Settimeofday(&tv); err != nil {
+			logrus.WithError(err).Warn("error setting system time")
+			return false, nil
+		}
+		logrus.Debug("synced time with host")
+		return false, nil
 	}
 
 	if err := os.MkdirAll("/root/.ssh", 0700); err != nil {
-		return fmt.Errorf("error creating /root/.ssh directory: %w", err)
+		return false, fmt.Errorf("error creating /root/.ssh directory: %w", err)
 	}
 
-	if err := os.WriteFile("/root/.ssh/authorized_keys", line, 0600); err != nil {
-		return fmt.Errorf("error writing authorized_keys: %w", err)
+	if err := os.WriteFile("/root/.ssh/authorized_keys", []byte(msg+"\n"), 0600); err != nil {
+		return false, fmt.Errorf("error writing authorized_keys: %w", err)
+	}
+	if guest != nil {
+		if err := guest.writeAuthorizedKeys([]byte(msg + "\n")); err != nil {
+			return false, err
+		}
 	}
 	logrus.Info("wrote authorized_keys")
-	return nil
+	return true, nil
+}
+
+// readHostLine reads a line from the host channel.
+// The channel returns EOF when the host side is not connected, in which case we wait for more data.
+func readHostLine(rdr *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		dt, err := rdr.ReadBytes('\n')
+		line = append(line, dt...)
+		if err != nil {
+			if err == io.EOF {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return nil, err
+		}
+		return line, nil
+	}
 }
 
 func initializeDevRan() error {
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// mountShared mounts a directory shared by the host, spec is in the form of <virtiofs|9p>:<tag>:<path>[:ro].
+func mountShared(spec string) error {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 3 || len(parts) > 4 {
+		return fmt.Errorf("invalid shared mount spec %q", spec)
+	}
+	typ, tag, target := parts[0], parts[1], parts[2]
+
+	var flags uintptr
+	if len(parts) == 4 && parts[3] == "ro" {
+		flags |= unix.MS_RDONLY
+	}
+
+	var (
+		mods []string
+		data string
+	)
+	switch typ {
+	case "9p":
+		mods = []string{"9pnet_virtio", "9p"}
+		data = "trans=virtio,version=9p2000.L,msize=262144"
+	case "virtiofs":
+		mods = []string{"virtiofs"}
+	default:
+		return fmt.Errorf("unsupported shared mount type %q", typ)
+	}
+
+	// The filesystem may be built into the kernel, in which case there is nothing to load.
+	if out, err := exec.Command("modprobe", append([]string{"-a"}, mods...)...).CombinedOutput(); err != nil {
+		logrus.WithError(err).WithField("type", typ).Debug(string(out))
+	}
+
+	logrus.WithField("tag", tag).WithField("target", target).Debug("mounting shared directory")
+	if err := mount(tag, target, typ, flags, data); err != nil {
+		return fmt.Errorf("error mounting shared directory %s: %w", target, err)
+	}
+	return nil
+}
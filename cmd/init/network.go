@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
 
 	dhcp "github.com/insomniacslk/dhcp/dhcpv4/nclient4"
@@ -14,7 +15,9 @@ import (
 
 const l0 = "lo"
 
-func setupNetwork() error {
+// setupNetwork configures every NIC with DHCP.
+// Only the NIC with the primary MAC (or the first one if that is not set) gets the default route and DNS config.
+func setupNetwork(primaryMAC string) error {
 	// The dhcp client uses getrandom(2) to generate a transaction id for the dhcp lease.
 	// This can hang, so set UROOT_NOHWRNG so that it uses /dev/urandom
 	// This is totally sufficient for our cases which is getting dhcp from qemu.
@@ -24,59 +27,22 @@ func setupNetwork() error {
 	if err != nil {
 		return fmt.Errorf("error getting link list: %w", err)
 	}
+
+	var configured bool
 	for _, link := range links {
 		attrs := link.Attrs()
 		if attrs.Name == l0 {
 			continue
 		}
 
-		logger := logrus.WithField("link", attrs.Name)
-		logger.Infof("Preparing link")
-		if err := netlink.LinkSetUp(link); err != nil {
-			return fmt.Errorf("error setting link %q to up state: %w", attrs.Name, err)
-		}
-
-		logger.Debug("Creating DHCP client")
-		client, err := dhcp.New(attrs.Name)
-		if err != nil {
-			return fmt.Errorf("error creating DHCP client: %w", err)
-		}
-
-		logger.Debug("Requesting DHCP lease")
-		lease, err := client.Request(context.TODO())
-		if err != nil {
-			return fmt.Errorf("error requesting DHCP: %w", err)
-		}
-
-		logger.WithField("addr", lease.ACK.YourIPAddr).Debug("Adding address to link")
-		if err := netlink.AddrAdd(link, &netlink.Addr{
-			IPNet: &net.IPNet{
-				IP:   lease.ACK.YourIPAddr,
-				Mask: lease.ACK.SubnetMask(),
-			},
-			Label:     attrs.Name,
-			Flags:     int(lease.ACK.Flags),
-			Broadcast: lease.ACK.BroadcastAddress(),
-		}); err != nil {
-			return fmt.Errorf("error adding address to link: %w", err)
-		}
-
-		if len(lease.ACK.DNS()) > 0 {
-			logger.Info("Setting DNS servers from DHCP lease")
-			b := strings.Builder{}
-			for _, addr := range lease.ACK.DNS() {
-				b.WriteString("nameserver " + addr.String() + "\n")
-			}
-			if err := os.WriteFile("/etc/resolv.conf", []byte(b.String()), 0644); err != nil {
-				return fmt.Errorf("error writing /etc/resolv.conf: %w", err)
-			}
+		primary := attrs.HardwareAddr.String() == primaryMAC
+		if primaryMAC == "" {
+			primary = !configured
 		}
-		if err := netlink.RouteAdd(&netlink.Route{
-			Gw: lease.ACK.ServerIPAddr,
-		}); err != nil {
-			return fmt.Errorf("error adding route: %w", err)
+		if err := setupLink(link, primary); err != nil {
+			return err
 		}
-		break
+		configured = true
 	}
 
 	lo, err := netlink.LinkByName("lo")
@@ -89,3 +55,75 @@ func setupNetwork() error {
 
 	return nil
 }
+
+// ipv6ConfPath is the per interface IPv6 sysctl dir.
+const ipv6ConfPath = "/proc/sys/net/ipv6/conf"
+
+// setupLink brings up the link and configures it with DHCP.
+// IPv6 addresses are configured by the kernel with SLAAC when the network has IPv6.
+func setupLink(link netlink.Link, primary bool) error {
+	attrs := link.Attrs()
+	logger := logrus.WithField("link", attrs.Name)
+	logger.Infof("Preparing link")
+
+	// Keep accepting router advertisements when forwarding gets enabled, e.g. by dockerd with IPv6 enabled.
+	// Otherwise the SLAAC address and default route go away.
+	if err := os.WriteFile(filepath.Join(ipv6ConfPath, attrs.Name, "accept_ra"), []byte("2"), 0644); err != nil && !os.IsNotExist(err) {
+		logger.WithError(err).Warn("Could not set accept_ra")
+	}
+
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("error setting link %q to up state: %w", attrs.Name, err)
+	}
+
+	logger.Debug("Creating DHCP client")
+	client, err := dhcp.New(attrs.Name)
+	if err != nil {
+		return fmt.Errorf("error creating DHCP client: %w", err)
+	}
+
+	logger.Debug("Requesting DHCP lease")
+	lease, err := client.Request(context.TODO())
+	if err != nil {
+		return fmt.Errorf("error requesting DHCP: %w", err)
+	}
+
+	logger.WithField("addr", lease.ACK.YourIPAddr).Debug("Adding address to link")
+	if err := netlink.AddrAdd(link, &netlink.Addr{
+		IPNet: &net.IPNet{
+			IP:   lease.ACK.YourIPAddr,
+			Mask: lease.ACK.SubnetMask(),
+		},
+		Label:     attrs.Name,
+		Flags:     int(lease.ACK.Flags),
+		Broadcast: lease.ACK.BroadcastAddress(),
+	}); err != nil {
+		return fmt.Errorf("error adding address to link: %w", err)
+	}
+
+	if !primary {
+		return nil
+	}
+
+	if len(lease.ACK.DNS()) > 0 {
+		logger.Info("Setting DNS servers from DHCP lease")
+		b := strings.Builder{}
+		for _, addr := range lease.ACK.DNS() {
+			b.WriteString("nameserver " + addr.String() + "\n")
+		}
+		if err := os.WriteFile("/etc/resolv.conf", []byte(b.String()), 0644); err != nil {
+			return fmt.Errorf("error writing /etc/resolv.conf: %w", err)
+		}
+	}
+	// Not every DHCP server sets its own address as the gateway (passt does not), so prefer the router option.
+	gw := lease.ACK.ServerIPAddr
+	if routers := lease.ACK.Router(); len(routers) > 0 {
+		gw = routers[0]
+	}
+	if err := netlink.RouteAdd(&netlink.Route{
+		Gw: gw,
+	}); err != nil {
+		return fmt.Errorf("error adding route: %w", err)
+	}
+	return nil
+}
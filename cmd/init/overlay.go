@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// rootOverlayDir is created in read-only root disks at build time.
+// It is where the overlay layers get mounted before switching the root over.
+const rootOverlayDir = "/.overlay"
+
+// setupRootOverlay puts a writable overlay on top of the read-only root and makes it the new root.
+// layer is either "tmpfs" or "disk:<serial>", which is where writes to the root end up.
+// Either way the writes are lost when the VM exits.
+func setupRootOverlay(layer string) error {
+	logrus.WithField("layer", layer).Debug("setting up root overlay")
+
+	switch {
+	case layer == "tmpfs":
+		if err := mount("tmpfs", rootOverlayDir, "tmpfs", 0, "mode=0755"); err != nil {
+			return fmt.Errorf("error mounting tmpfs for root overlay: %w", err)
+		}
+	case strings.HasPrefix(layer, "disk:"):
+		dev, err := findDiskBySerial(strings.TrimPrefix(layer, "disk:"))
+		if err != nil {
+			return err
+		}
+		if err := mount(dev, rootOverlayDir, "ext4", 0, ""); err != nil {
+			return fmt.Errorf("error mounting scratch disk for root overlay: %w", err)
+		}
+	default:
+		return fmt.Errorf("invalid root overlay %q", layer)
+	}
+
+	var (
+		lower = filepath.Join(rootOverlayDir, "lower")
+		upper = filepath.Join(rootOverlayDir, "upper")
+		work  = filepath.Join(rootOverlayDir, "work")
+		root  = filepath.Join(rootOverlayDir, "root")
+	)
+	for _, p := range []string{lower, upper, work, root} {
+		if err := os.MkdirAll(p, 0755); err != nil {
+			return err
+		}
+	}
+
+	// Overlayfs may be built as a module, in which case it needs to be loaded first.
+	// Errors are ignored since it may also be built into the kernel.
+	if out, err := exec.Command("modprobe", "overlay").CombinedOutput(); err != nil {
+		logrus.WithError(err).WithField("output", string(out)).Debug("error loading overlay module")
+	}
+
+	// A non-recursive bind so the lower layer is only the root disk itself and not the mounts on top of it.
+	if err := bindMount("/", lower, true); err != nil {
+		return fmt.Errorf("error binding root for overlay: %w", err)
+	}
+
+	opts := "lowerdir=" + lower + ",upperdir=" + upper + ",workdir=" + work
+	if err := mount("overlay", root, "overlay", 0, opts); err != nil {
+		return fmt.Errorf("error mounting root overlay: %w", err)
+	}
+
+	for _, p := range []string{"/dev", "/proc", "/sys", "/run"} {
+		target := filepath.Join(root, p)
+		if err := unix.Mount(p, target, "", unix.MS_MOVE, ""); err != nil {
+			// Not a mount point, nothing to move.
+			if errors.Is(err, unix.EINVAL) {
+				continue
+			}
+			return fmt.Errorf("error moving %s to new root: %w", p, err)
+		}
+	}
+
+	// The kernel disk is mounted under /run, which is not moved with it when /run is not a mount point.
+	if mounted, err := isMountPoint(kernelDiskMount); err == nil && mounted {
+		target := filepath.Join(root, kernelDiskMount)
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		if err := unix.Mount(kernelDiskMount, target, "", unix.MS_MOVE, ""); err != nil {
+			return fmt.Errorf("error moving kernel disk to new root: %w", err)
+		}
+	}
+
+	// This is the same as what switch_root does coming out of the initramfs.
+	if err := os.Chdir(root); err != nil {
+		return err
+	}
+	if err := unix.Mount(".", "/", "", unix.MS_MOVE, ""); err != nil {
+		return fmt.Errorf("error moving root overlay to /: %w", err)
+	}
+	if err := unix.Chroot("."); err != nil {
+		return fmt.Errorf("error changing root to overlay: %w", err)
+	}
+	return os.Chdir("/")
+}
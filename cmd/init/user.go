@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// dockerGroup is the group dockerd gives access to its socket to.
+const dockerGroup = "docker"
+
+// guestUser is a non-root user in the VM which matches the host user.
+type guestUser struct {
+	name string
+	uid  int
+	gid  int
+	home string
+	sudo bool
+}
+
+// parseGuestUser parses a guest user spec in the form of <name>:<uid>:<gid>.
+func parseGuestUser(s string, sudo bool) (*guestUser, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid guest user %q, must be <name>:<uid>:<gid>", s)
+	}
+	uid, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid guest user uid: %w", err)
+	}
+	gid, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid guest user gid: %w", err)
+	}
+	return &guestUser{name: parts[0], uid: uid, gid: gid, home: "/home/" + parts[0], sudo: sudo}, nil
+}
+
+// Paths of the user databases, these are changed in tests.
+var (
+	passwdPath = "/etc/passwd"
+	groupPath  = "/etc/group"
+	shadowPath = "/etc/shadow"
+)
+
+// setupGuestUser creates the user and its group, unless they already exist, and adds it to the docker group.
+// The files in /etc are edited directly rather than using useradd and friends since those differ between distros.
+func setupGuestUser(u *guestUser) error {
+	home, err := addGuestUser(u)
+	if err != nil {
+		return err
+	}
+	u.home = home
+
+	if err := os.MkdirAll(filepath.Join(u.home, ".ssh"), 0700); err != nil {
+		return err
+	}
+	for _, p := range []string{u.home, filepath.Join(u.home, ".ssh")} {
+		if err := os.Chown(p, u.uid, u.gid); err != nil {
+			return err
+		}
+	}
+
+	if u.sudo {
+		if _, err := os.Stat("/etc/sudoers.d"); err != nil {
+			logrus.Warn("sudo is not installed in the VM, guest user will not have sudo")
+		} else if err := os.WriteFile(filepath.Join("/etc/sudoers.d", u.name), []byte(u.name+" ALL=(ALL) NOPASSWD:ALL\n"), 0440); err != nil {
+			return fmt.Errorf("error configuring sudo for guest user: %w", err)
+		}
+	}
+
+	logrus.WithField("user", u.name).WithField("uid", u.uid).WithField("gid", u.gid).Info("created guest user")
+	return nil
+}
+
+// addGuestUser adds the user and its group to the user databases, unless they already exist, and adds it to the docker group.
+// It returns the home dir of the user.
+func addGuestUser(u *guestUser) (string, error) {
+	if u.uid == 0 || u.gid == 0 {
+		return "", fmt.Errorf("guest user %s cannot have uid or gid 0", u.name)
+	}
+
+	passwd, err := readDB(passwdPath)
+	if err != nil {
+		return "", err
+	}
+	groups, err := readDB(groupPath)
+	if err != nil {
+		return "", err
+	}
+
+	if existing := findEntry(passwd, 2, strconv.Itoa(u.uid)); existing != nil && existing[0] != u.name {
+		return "", fmt.Errorf("uid %d is already used by user %s", u.uid, existing[0])
+	}
+
+	if findEntry(groups, 2, strconv.Itoa(u.gid)) == nil {
+		if err := appendLine(groupPath, fmt.Sprintf("%s:x:%d:", u.name, u.gid)); err != nil {
+			return "", err
+		}
+	}
+
+	home := u.home
+	if existing := findEntry(passwd, 0, u.name); existing != nil {
+		if existing[2] != strconv.Itoa(u.uid) {
+			return "", fmt.Errorf("user %s already exists with uid %s instead of %d", u.name, existing[2], u.uid)
+		}
+		home = existing[5]
+	} else {
+		shell := "/bin/sh"
+		if _, err := os.Stat("/bin/bash"); err == nil {
+			shell = "/bin/bash"
+		}
+		if err := appendLine(passwdPath, fmt.Sprintf("%s:x:%d:%d::%s:%s", u.name, u.uid, u.gid, home, shell)); err != nil {
+			return "", err
+		}
+		// "*" disables password logins without locking the account, locked accounts can't login with ssh keys either.
+		if err := appendLine(shadowPath, u.name+":*:19000:0:99999:7:::"); err != nil {
+			return "", err
+		}
+	}
+
+	if err := addToDockerGroup(u.name); err != nil {
+		return "", err
+	}
+	return home, nil
+}
+
+// writeAuthorizedKeys writes the authorized keys for the guest user.
+func (u *guestUser) writeAuthorizedKeys(keys []byte) error {
+	p := filepath.Join(u.home, ".ssh", "authorized_keys")
+	if err := os.WriteFile(p, keys, 0600); err != nil {
+		return fmt.Errorf("error writing authorized_keys for %s: %w", u.name, err)
+	}
+	return os.Chown(p, u.uid, u.gid)
+}
+
+// addToDockerGroup adds the user to the docker group, creating the group if it doesn't exist.
+func addToDockerGroup(name string) error {
+	groups, err := readDB(groupPath)
+	if err != nil {
+		return err
+	}
+
+	for i := range groups {
+		g := &groups[i]
+		if g.fields == nil || g.fields[0] != dockerGroup {
+			continue
+		}
+		// The member list is the 4th field, which may be missing.
+		if g.n < 4 {
+			g.n = 4
+		}
+		members := g.fields[3]
+		for _, m := range strings.Split(members, ",") {
+			if m == name {
+				return nil
+			}
+		}
+		if members == "" {
+			g.fields[3] = name
+		} else {
+			g.fields[3] += "," + name
+		}
+		return writeDB(groupPath, groups)
+	}
+
+	// Pick a free system gid for the group
+	gid := 999
+	for ; gid > 0; gid-- {
+		if findEntry(groups, 2, strconv.Itoa(gid)) == nil {
+			break
+		}
+	}
+	return appendLine(groupPath, fmt.Sprintf("%s:x:%d:%s", dockerGroup, gid, name))
+}
+
+// dbEntry is a line of a colon separated file like /etc/passwd or /etc/group.
+// Comments and blank lines have no fields and are kept as is so they survive writing the file back.
+type dbEntry struct {
+	fields []string
+	// n is the number of fields in the file, fields is padded so any of the standard fields can be indexed.
+	n    int
+	line string
+}
+
+// readDB reads a colon separated file like /etc/passwd or /etc/group.
+func readDB(p string) ([]dbEntry, error) {
+	dt, err := os.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var entries []dbEntry
+	for _, line := range strings.Split(strings.TrimSuffix(string(dt), "\n"), "\n") {
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			entries = append(entries, dbEntry{line: line})
+			continue
+		}
+		fields := strings.Split(line, ":")
+		n := len(fields)
+		for len(fields) < 7 {
+			fields = append(fields, "")
+		}
+		entries = append(entries, dbEntry{fields: fields, n: n})
+	}
+	return entries, nil
+}
+
+func writeDB(p string, entries []dbEntry) error {
+	var b strings.Builder
+	for _, e := range entries {
+		if e.fields == nil {
+			b.WriteString(e.line)
+		} else {
+			b.WriteString(strings.Join(e.fields[:e.n], ":"))
+		}
+		b.WriteString("\n")
+	}
+	return os.WriteFile(p, []byte(b.String()), 0644)
+}
+
+// findEntry returns the fields of the first entry with the value in the passed in field.
+func findEntry(entries []dbEntry, field int, value string) []string {
+	for _, e := range entries {
+		if e.fields != nil && e.fields[field] == value {
+			return e.fields
+		}
+	}
+	return nil
+}
+
+func appendLine(p, line string) error {
+	dt, err := os.ReadFile(p)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(dt) > 0 && dt[len(dt)-1] != '\n' {
+		line = "\n" + line
+	}
+
+	mode := os.FileMode(0644)
+	if p == shadowPath {
+		mode = 0640
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND|os.O_CREATE, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(line + "\n")
+	return err
+}
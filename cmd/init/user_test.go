@@ -0,0 +1,192 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setupUserDB points the user databases at temp files with the passed in content.
+func setupUserDB(t *testing.T, passwd, group string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	oldPasswd, oldGroup, oldShadow := passwdPath, groupPath, shadowPath
+	t.Cleanup(func() {
+		passwdPath, groupPath, shadowPath = oldPasswd, oldGroup, oldShadow
+	})
+	passwdPath = filepath.Join(dir, "passwd")
+	groupPath = filepath.Join(dir, "group")
+	shadowPath = filepath.Join(dir, "shadow")
+
+	for p, content := range map[string]string{passwdPath: passwd, groupPath: group} {
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readFile(t *testing.T, p string) string {
+	t.Helper()
+	dt, err := os.ReadFile(p)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return string(dt)
+}
+
+const testPasswd = `# system users
+root:x:0:0:root:/root:/bin/bash
+daemon:x:1:1:daemon:/usr/sbin:/usr/sbin/nologin
+`
+
+func TestAddGuestUser(t *testing.T) {
+	cases := []struct {
+		name   string
+		passwd string
+		group  string
+		user   guestUser
+
+		err          bool
+		home         string
+		expectPasswd string
+		expectGroup  string
+	}{
+		{
+			name:   "new user",
+			passwd: testPasswd,
+			group:  "# groups\nroot:x:0:\nusers:x:100:\n",
+			user:   guestUser{name: "me", uid: 1000, gid: 1000, home: "/home/me"},
+			home:   "/home/me",
+			expectPasswd: testPasswd +
+				"me:x:1000:1000::/home/me:/bin/bash\n",
+			expectGroup: "# groups\nroot:x:0:\nusers:x:100:\nme:x:1000:\ndocker:x:999:me\n",
+		},
+		{
+			name:         "existing group and docker group with members",
+			passwd:       testPasswd,
+			group:        "root:x:0:\n# docker\ndocker:x:998:other,another\nusers:x:100:\n",
+			user:         guestUser{name: "me", uid: 1000, gid: 100, home: "/home/me"},
+			home:         "/home/me",
+			expectPasswd: testPasswd + "me:x:1000:100::/home/me:/bin/bash\n",
+			expectGroup:  "root:x:0:\n# docker\ndocker:x:998:other,another,me\nusers:x:100:\n",
+		},
+		{
+			name:         "docker group without member field",
+			passwd:       testPasswd,
+			group:        "docker:x:998\nme:x:1000:\n",
+			user:         guestUser{name: "me", uid: 1000, gid: 1000, home: "/home/me"},
+			home:         "/home/me",
+			expectPasswd: testPasswd + "me:x:1000:1000::/home/me:/bin/bash\n",
+			expectGroup:  "docker:x:998:me\nme:x:1000:\n",
+		},
+		{
+			name:         "existing user",
+			passwd:       testPasswd + "me:x:1000:1000::/var/home/me:/bin/zsh\n",
+			group:        "me:x:1000:\ndocker:x:999:me\n",
+			user:         guestUser{name: "me", uid: 1000, gid: 1000, home: "/home/me"},
+			home:         "/var/home/me",
+			expectPasswd: testPasswd + "me:x:1000:1000::/var/home/me:/bin/zsh\n",
+			expectGroup:  "me:x:1000:\ndocker:x:999:me\n",
+		},
+		{
+			name:   "existing user with another uid",
+			passwd: testPasswd + "me:x:1001:1001::/home/me:/bin/bash\n",
+			user:   guestUser{name: "me", uid: 1000, gid: 1000, home: "/home/me"},
+			err:    true,
+		},
+		{
+			name:   "uid used by another user",
+			passwd: testPasswd + "other:x:1000:1000::/home/other:/bin/bash\n",
+			user:   guestUser{name: "me", uid: 1000, gid: 1000, home: "/home/me"},
+			err:    true,
+		},
+		{
+			name:   "root uid",
+			passwd: testPasswd,
+			user:   guestUser{name: "me", uid: 0, gid: 0, home: "/home/me"},
+			err:    true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			setupUserDB(t, tc.passwd, tc.group)
+
+			home, err := addGuestUser(&tc.user)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				if got := readFile(t, passwdPath); got != tc.passwd {
+					t.Errorf("passwd should not be changed on error, got:\n%s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if home != tc.home {
+				t.Errorf("expected home %s, got %s", tc.home, home)
+			}
+			// The shell depends on the host running the tests.
+			got := strings.ReplaceAll(readFile(t, passwdPath), ":/bin/sh\n", ":/bin/bash\n")
+			if got != tc.expectPasswd {
+				t.Errorf("unexpected passwd, expected:\n%s\ngot:\n%s", tc.expectPasswd, got)
+			}
+			if got := readFile(t, groupPath); got != tc.expectGroup {
+				t.Errorf("unexpected group, expected:\n%s\ngot:\n%s", tc.expectGroup, got)
+			}
+
+			shadow := readFile(t, shadowPath)
+			if created := !strings.Contains(tc.passwd, "\n"+tc.user.name+":"); created != strings.HasPrefix(shadow, tc.user.name+":*:") {
+				t.Errorf("unexpected shadow: %q", shadow)
+			}
+
+			// Adding the user again changes nothing.
+			if _, err := addGuestUser(&tc.user); err != nil {
+				t.Fatal(err)
+			}
+			if got := readFile(t, groupPath); got != tc.expectGroup {
+				t.Errorf("group changed when adding the user again:\n%s", got)
+			}
+		})
+	}
+}
+
+func TestReadWriteDB(t *testing.T) {
+	cases := map[string]string{
+		"comments":   "# comment\nroot:x:0:0:root:/root:/bin/bash\n\n#another\n",
+		"groups":     "root:x:0:\ndocker:x:999:a,b\nshort:x:5\n",
+		"no newline": "root:x:0:",
+	}
+	for name, content := range cases {
+		t.Run(name, func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "db")
+			if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			entries, err := readDB(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e := findEntry(entries, 0, "root"); e == nil || e[2] != "0" {
+				t.Errorf("expected root entry, got %v", e)
+			}
+			if e := findEntry(entries, 0, "# comment"); e != nil {
+				t.Errorf("comments should not match entries: %v", e)
+			}
+
+			if err := writeDB(p, entries); err != nil {
+				t.Fatal(err)
+			}
+			expected := strings.TrimSuffix(content, "\n") + "\n"
+			if got := readFile(t, p); got != expected {
+				t.Errorf("expected file to be written back as is, expected:\n%q\ngot:\n%q", expected, got)
+			}
+		})
+	}
+}
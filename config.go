@@ -4,13 +4,18 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
 const (
-	kernelImageContext = "kernel-image"
-	initrdImageContext = "initrd-image"
-	modulesContext     = "kernel-modules"
+	kernelImageContext      = "kernel-image"
+	initrdImageContext      = "initrd-image"
+	modulesContext          = "kernel-modules"
+	rootfsContext           = "rootfs-context"
+	rootfsDockerfileContext = "rootfs-dockerfile"
+	copyInContextPrefix     = "copy-in-"
+	mobyContext             = "moby-local"
 )
 
 type specFlag struct {
@@ -19,11 +24,105 @@ type specFlag struct {
 }
 
 type vmImageConfig struct {
-	kernel  specFlag
-	initrd  specFlag
-	modules specFlag
-	rootfs  string
-	size    string
+	kernel      specFlag
+	kernelIndex string
+	kernelLock  string
+	initrd      specFlag
+	modules     specFlag
+	rootfs      rootfsFlag
+	distro      string
+	packages    stringListFlag
+	runs        stringListFlag
+	copyIns     copyInFlag
+	moby        specFlag
+	mobyURL     string
+	size        string
+	fs          string
+	rootMode    string
+	preset      string
+}
+
+// stringListFlag is a flag that can be specified multiple times.
+type stringListFlag []string
+
+func (f *stringListFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *stringListFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// copyIn is a file or directory from the host to copy into the rootfs.
+type copyIn struct {
+	src   string
+	dest  string
+	mode  *os.FileMode
+	isDir bool
+}
+
+// contextName is the name of the local build context used for the copy at the passed in index.
+func (c copyIn) contextName(i int) string {
+	return copyInContextPrefix + strconv.Itoa(i)
+}
+
+// contextDir is the directory shared with buildkit for the copy.
+// For files this is the parent directory, only the file itself is transferred.
+func (c copyIn) contextDir() string {
+	if c.isDir {
+		return c.src
+	}
+	return filepath.Dir(c.src)
+}
+
+func (c copyIn) String() string {
+	s := c.src + ":" + c.dest
+	if c.mode != nil {
+		s += ":" + strconv.FormatUint(uint64(*c.mode), 8)
+	}
+	return s
+}
+
+// copyInFlag is a repeatable flag in the form of <host path>:<guest path>[:mode].
+type copyInFlag []copyIn
+
+func (f *copyInFlag) String() string {
+	var ls []string
+	for _, c := range *f {
+		ls = append(ls, c.String())
+	}
+	return strings.Join(ls, ", ")
+}
+
+func (f *copyInFlag) Set(s string) error {
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return fmt.Errorf("invalid format, must be <host path>:<guest path>[:mode]: %s", s)
+	}
+
+	c := copyIn{src: parts[0], dest: parts[1]}
+	fi, err := os.Stat(c.src)
+	if err != nil {
+		return err
+	}
+	c.isDir = fi.IsDir()
+
+	if !filepath.IsAbs(c.dest) {
+		return fmt.Errorf("guest path must be absolute: %s", c.dest)
+	}
+
+	if len(parts) == 3 {
+		m, err := strconv.ParseUint(parts[2], 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid mode %q, must be octal: %w", parts[2], err)
+		}
+		mode := os.FileMode(m)
+		c.mode = &mode
+	}
+
+	*f = append(*f, c)
+	return nil
 }
 
 func (f *specFlag) Set(s string) error {
@@ -47,6 +146,28 @@ func (f *specFlag) Set(s string) error {
 	return nil
 }
 
+// rootfsFlag is a specFlag which treats values without a scheme as an image ref.
+type rootfsFlag struct {
+	specFlag
+}
+
+func (f *rootfsFlag) Set(s string) error {
+	if s != "" && !strings.Contains(s, "://") {
+		s = "docker-image://" + s
+	}
+	return f.specFlag.Set(s)
+}
+
+// dockerfile splits a dockerfile://<path>[#target] ref into the path to the Dockerfile and the build target.
+// If the path is a directory, the Dockerfile in that directory is used.
+func (f *rootfsFlag) dockerfile() (p string, target string) {
+	p, target, _ = strings.Cut(f.ref, "#")
+	if fi, err := os.Stat(p); err == nil && fi.IsDir() {
+		p = filepath.Join(p, "Dockerfile")
+	}
+	return p, target
+}
+
 func (f *specFlag) isEmpty() bool {
 	return f.scheme == "" && f.ref == ""
 }
@@ -78,5 +199,24 @@ func getLocalContexts(cfg config) map[string]string {
 		get()[modulesContext] = filepath.Dir(cfg.ImageConfig.modules.ref)
 	}
 
+	if cfg.ImageConfig.moby.scheme == "local" {
+		get()[mobyContext] = cfg.ImageConfig.moby.ref
+	}
+
+	for i, c := range cfg.ImageConfig.copyIns {
+		get()[c.contextName(i)] = c.contextDir()
+	}
+
+	switch cfg.ImageConfig.rootfs.scheme {
+	case "dockerfile":
+		p, _ := cfg.ImageConfig.rootfs.dockerfile()
+		get()[rootfsContext] = filepath.Dir(p)
+		get()[rootfsDockerfileContext] = filepath.Dir(p)
+	case "local":
+		get()[rootfsContext] = cfg.ImageConfig.rootfs.ref
+	case "tar":
+		get()[rootfsContext] = filepath.Dir(cfg.ImageConfig.rootfs.ref)
+	}
+
 	return contexts
 }
@@ -27,6 +27,7 @@ type config struct {
 	CacheSpec   string
 	Tag         string
 	Push        bool
+	KernelCheck string
 }
 
 type logFormatter struct {
@@ -62,10 +63,6 @@ func do(ctx context.Context) error {
 
 	flag.Parse()
 
-	if len(cfg.VM.SocketForwards) == 0 {
-		cfg.VM.SocketForwards.Set("/run/docker.sock")
-	}
-
 	if cfg.Debug {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
@@ -88,6 +85,10 @@ func do(ctx context.Context) error {
 			return err
 		}
 
+		if err := applyPreset(&cfg); err != nil {
+			return err
+		}
+
 		if cfg.Debug {
 			logrus.SetLevel(logrus.DebugLevel)
 		}
@@ -111,8 +112,8 @@ func do(ctx context.Context) error {
 			return err
 		}
 
-		if len(cfg.VM.SocketForwards) == 0 {
-			cfg.VM.SocketForwards.Set("/run/docker.sock")
+		if err := applyPreset(&cfg); err != nil {
+			return err
 		}
 
 		if cfg.Debug {
@@ -133,7 +134,134 @@ func do(ctx context.Context) error {
 		}
 
 		return doRunner(ctx, cfg, docker.Transport())
+	case "rm":
+		set := flag.NewFlagSet("rm", flag.ExitOnError)
+		set.StringVar(&cfg.StateDir, "state-dir", cfg.StateDir, "directory to use for state files (socket, image, etc)")
+		volumes := set.Bool("volumes", false, "also remove data disks")
+
+		var args []string
+		if flag.NArg() > 1 {
+			args = flag.Args()[1:]
+		}
+
+		if err := set.Parse(args); err != nil {
+			return err
+		}
+		return removeState(cfg.StateDir, *volumes)
+	case "snapshot":
+		set := flag.NewFlagSet("snapshot", flag.ExitOnError)
+		set.BoolVar(&cfg.Debug, "debug", cfg.Debug, "enable debug logging")
+		set.StringVar(&cfg.StateDir, "state-dir", cfg.StateDir, "directory to use for state files (socket, image, etc)")
+		live := set.Bool("live", false, "save the full state of the running VM instead of the root disk of a stopped VM, restore with run --from-snapshot")
+		set.Usage = func() {
+			fmt.Fprintln(set.Output(), "Usage: snapshot [flags] save|restore|list [name]")
+			fmt.Fprintln(set.Output(), "Manage snapshots of the root disk of a stopped VM that was run with --persist.")
+			fmt.Fprintln(set.Output(), "With --live, save and list snapshots of the full state of a running VM.")
+			set.PrintDefaults()
+		}
+
+		var args []string
+		if flag.NArg() > 1 {
+			args = flag.Args()[1:]
+		}
+
+		if err := set.Parse(args); err != nil {
+			return err
+		}
+
+		if cfg.Debug {
+			logrus.SetLevel(logrus.DebugLevel)
+		}
+
+		switch set.Arg(0) {
+		case "save", "restore":
+			if set.NArg() != 2 {
+				set.Usage()
+				return fmt.Errorf("snapshot %s requires a name", set.Arg(0))
+			}
+		case "list":
+		default:
+			set.Usage()
+			return fmt.Errorf("unknown snapshot command: %q", set.Arg(0))
+		}
+		if *live {
+			return doLiveSnapshot(cfg, set.Args())
+		}
+		return doSnapshot(ctx, cfg, docker.Transport(), set.Args())
+	case "port":
+		set := flag.NewFlagSet("port", flag.ExitOnError)
+		set.Usage = func() {
+			fmt.Fprintln(set.Output(), "Usage: port add|rm <env> <guestport>[/tcp|/udp]")
+			fmt.Fprintln(set.Output(), "       port ls <env>")
+			fmt.Fprintln(set.Output(), "Change the ports forwarded to a running VM, <env> is its state dir.")
+			fmt.Fprintln(set.Output(), "Added ports are reachable on the address of the runner container, which is printed by add and ls.")
+			fmt.Fprintln(set.Output(), "That address is only reachable from the machine docker runs on, e.g. not from the host with Docker Desktop.")
+			fmt.Fprintln(set.Output(), "Port 22/tcp is used to connect to the VM and cannot be removed.")
+			set.PrintDefaults()
+		}
+
+		var args []string
+		if flag.NArg() > 1 {
+			args = flag.Args()[1:]
+		}
+
+		if err := set.Parse(args); err != nil {
+			return err
+		}
+
+		switch set.Arg(0) {
+		case "add", "rm":
+			if set.NArg() != 3 {
+				set.Usage()
+				return fmt.Errorf("port %s requires a state dir and a port", set.Arg(0))
+			}
+		case "ls":
+			if set.NArg() != 2 {
+				set.Usage()
+				return fmt.Errorf("port ls requires a state dir")
+			}
+		default:
+			set.Usage()
+			return fmt.Errorf("unknown port command: %q", set.Arg(0))
+		}
+		return doPort(set.Arg(1), append([]string{set.Arg(0)}, set.Args()[2:]...))
+	case "status", "pause", "resume", "powerdown", "qmp":
+		cmd := flag.Arg(0)
+		set := flag.NewFlagSet(cmd, flag.ExitOnError)
+		set.Usage = func() {
+			fmt.Fprintln(set.Output(), "Usage: status|pause|resume|powerdown <env>")
+			fmt.Fprintln(set.Output(), "       qmp <env> <json>")
+			fmt.Fprintln(set.Output(), "Control a running VM over its QMP socket, <env> is its state dir.")
+			fmt.Fprintln(set.Output(), "powerdown shuts the VM down cleanly, also when it has no ACPI.")
+			fmt.Fprintln(set.Output(), "qmp sends a raw QMP request, e.g. '{\"execute\": \"query-status\"}', and prints the return value.")
+			set.PrintDefaults()
+		}
+
+		var args []string
+		if flag.NArg() > 1 {
+			args = flag.Args()[1:]
+		}
+
+		if err := set.Parse(args); err != nil {
+			return err
+		}
+
+		n := 1
+		if cmd == "qmp" {
+			n = 2
+		}
+		if set.NArg() != n {
+			set.Usage()
+			if cmd == "qmp" {
+				return fmt.Errorf("qmp requires a state dir and a request")
+			}
+			return fmt.Errorf("%s requires a state dir", cmd)
+		}
+		return doVMControl(ctx, set.Arg(0), append([]string{cmd}, set.Args()[1:]...))
 	case "":
+		if err := applyPreset(&cfg); err != nil {
+			return err
+		}
 		dgst, err := doBuilder(ctx, cfg, docker.Transport())
 		if err != nil {
 			return err
@@ -145,3 +273,13 @@ func do(ctx context.Context) error {
 	}
 	return nil
 }
+
+// applyPreset fills in the defaults from the workload preset.
+// This must be done after all flags are parsed so explicitly set values are not overwritten.
+func applyPreset(cfg *config) error {
+	if err := cfg.VM.ApplyPreset(); err != nil {
+		return err
+	}
+	cfg.ImageConfig.preset = cfg.VM.Preset
+	return nil
+}
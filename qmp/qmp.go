@@ -0,0 +1,206 @@
+// Package qmp is a client for the qemu machine protocol, which the runner exposes on a socket in the state dir.
+package qmp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Error is an error returned by qemu for a command.
+type Error struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *Error) Error() string {
+	return e.Class + ": " + e.Desc
+}
+
+// Status is the run state of the VM, as returned by query-status.
+type Status struct {
+	Running bool `json:"running"`
+	// Status is qemu's name for the run state, e.g. "running", "paused", or "shutdown".
+	Status string `json:"status"`
+}
+
+// message is any message sent by qemu.
+type message struct {
+	QMP    json.RawMessage `json:"QMP"`
+	Event  string          `json:"event"`
+	Return json.RawMessage `json:"return"`
+	Error  *Error          `json:"error"`
+	ID     *uint64         `json:"id"`
+}
+
+// Client is a connection to a QMP socket.
+// Commands are run one at a time, events sent by qemu are ignored.
+// Each command is sent with an id, so the response of a cancelled command is skipped by the next one.
+type Client struct {
+	mu   sync.Mutex
+	conn net.Conn
+	dec  *json.Decoder
+	id   uint64
+}
+
+// Dial connects to the QMP socket at the passed in path.
+func Dial(ctx context.Context, p string) (*Client, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", p)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewClient(ctx, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewClient performs the QMP handshake on the connection.
+func NewClient(ctx context.Context, conn net.Conn) (*Client, error) {
+	c := &Client{conn: conn, dec: json.NewDecoder(conn)}
+
+	defer c.watch(ctx)()
+
+	var greeting message
+	if err := c.dec.Decode(&greeting); err != nil {
+		return nil, fmt.Errorf("error reading QMP greeting: %w", err)
+	}
+	if greeting.QMP == nil {
+		return nil, errors.New("invalid QMP greeting")
+	}
+
+	if err := c.execute(map[string]json.RawMessage{"execute": json.RawMessage(`"qmp_capabilities"`)}, nil); err != nil {
+		return nil, fmt.Errorf("error negotiating QMP capabilities: %w", err)
+	}
+	return c, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// watch interrupts reads and writes on the connection when the context is cancelled.
+// The returned function must be called when the request is done, it makes the connection usable again.
+func (c *Client) watch(ctx context.Context) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			c.conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		if ctx.Err() == nil {
+			return
+		}
+		c.conn.SetDeadline(time.Time{})
+		// The decoder keeps returning the deadline error, a new one continues where it left off.
+		c.dec = json.NewDecoder(io.MultiReader(c.dec.Buffered(), c.conn))
+	}
+}
+
+// execute sends the request with a new id and decodes the return value of the response into result, if not nil.
+func (c *Client) execute(req map[string]json.RawMessage, result any) error {
+	c.id++
+	id := c.id
+	req["id"] = json.RawMessage(strconv.FormatUint(id, 10))
+
+	dt, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if _, err := c.conn.Write(dt); err != nil {
+		return err
+	}
+
+	for {
+		var msg message
+		if err := c.dec.Decode(&msg); err != nil {
+			return fmt.Errorf("error reading QMP response: %w", err)
+		}
+		// Responses to earlier, cancelled, commands are skipped.
+		// qemu can only leave out the id when it could not parse the request.
+		if msg.Event != "" || (msg.ID != nil && *msg.ID != id) {
+			continue
+		}
+		if msg.Error != nil {
+			return msg.Error
+		}
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(msg.Return, result)
+	}
+}
+
+// Execute runs the command with the passed in arguments, which may be nil.
+// The return value of the command is decoded into result, if not nil.
+func (c *Client) Execute(ctx context.Context, cmd string, args any, result any) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.watch(ctx)()
+
+	req := map[string]json.RawMessage{}
+	var err error
+	if req["execute"], err = json.Marshal(cmd); err != nil {
+		return err
+	}
+	if args != nil {
+		if req["arguments"], err = json.Marshal(args); err != nil {
+			return fmt.Errorf("error encoding arguments of %s: %w", cmd, err)
+		}
+	}
+	if err := c.execute(req, result); err != nil {
+		return fmt.Errorf("error running %s: %w", cmd, err)
+	}
+	return nil
+}
+
+// Raw sends a request as-is, apart from its id, and returns the return value of the response.
+func (c *Client) Raw(ctx context.Context, req json.RawMessage) (json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(req, &fields); err != nil || fields == nil {
+		return nil, errors.New("request is not a valid JSON object")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.watch(ctx)()
+
+	var ret json.RawMessage
+	if err := c.execute(fields, &ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Status returns the run state of the VM.
+func (c *Client) Status(ctx context.Context) (Status, error) {
+	var s Status
+	err := c.Execute(ctx, "query-status", nil, &s)
+	return s, err
+}
+
+// Pause stops the VM's CPUs.
+func (c *Client) Pause(ctx context.Context) error {
+	return c.Execute(ctx, "stop", nil, nil)
+}
+
+// Resume restarts the VM's CPUs after a pause.
+func (c *Client) Resume(ctx context.Context) error {
+	return c.Execute(ctx, "cont", nil, nil)
+}
@@ -0,0 +1,166 @@
+package qmp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeServer speaks just enough QMP to test the client.
+// It answers each command with the response from the handler, sending an event first so the client has to skip it.
+func fakeServer(t *testing.T, handler func(cmd string, args json.RawMessage) (any, *Error)) *Client {
+	t.Helper()
+
+	// A real socket is used since net.Pipe has no buffer, a late response would block the next request.
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "qmp.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("unix", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	go func() {
+		enc := json.NewEncoder(server)
+		dec := json.NewDecoder(server)
+		enc.Encode(map[string]any{"QMP": map[string]any{"version": map[string]any{}, "capabilities": []string{}}})
+
+		for {
+			var req struct {
+				Execute   string          `json:"execute"`
+				Arguments json.RawMessage `json:"arguments"`
+				ID        json.RawMessage `json:"id"`
+			}
+			if err := dec.Decode(&req); err != nil {
+				return
+			}
+			enc.Encode(map[string]any{"event": "TEST", "data": map[string]any{}})
+
+			if req.Execute == "qmp_capabilities" {
+				enc.Encode(map[string]any{"return": map[string]any{}, "id": req.ID})
+				continue
+			}
+			ret, qerr := handler(req.Execute, req.Arguments)
+			if qerr != nil {
+				enc.Encode(map[string]any{"error": qerr, "id": req.ID})
+				continue
+			}
+			enc.Encode(map[string]any{"return": ret, "id": req.ID})
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := NewClient(ctx, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestClient(t *testing.T) {
+	var cmds []string
+	c := fakeServer(t, func(cmd string, args json.RawMessage) (any, *Error) {
+		cmds = append(cmds, cmd)
+		switch cmd {
+		case "query-status":
+			return Status{Running: true, Status: "running"}, nil
+		case "stop", "cont":
+			return map[string]any{}, nil
+		case "echo":
+			return args, nil
+		}
+		return nil, &Error{Class: "CommandNotFound", Desc: "The command " + cmd + " has not been found"}
+	})
+
+	ctx := context.Background()
+
+	s, err := c.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != (Status{Running: true, Status: "running"}) {
+		t.Errorf("unexpected status: %+v", s)
+	}
+
+	for _, f := range []func(context.Context) error{c.Pause, c.Resume} {
+		if err := f(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []string{"query-status", "stop", "cont"}
+	if len(cmds) != len(expected) {
+		t.Fatalf("expected commands %v, got %v", expected, cmds)
+	}
+	for i := range expected {
+		if cmds[i] != expected[i] {
+			t.Fatalf("expected commands %v, got %v", expected, cmds)
+		}
+	}
+
+	ret, err := c.Raw(ctx, json.RawMessage(`{"execute": "echo", "arguments": {"foo": "bar"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var echo map[string]string
+	if err := json.Unmarshal(ret, &echo); err != nil {
+		t.Fatal(err)
+	}
+	if echo["foo"] != "bar" {
+		t.Errorf("unexpected return value: %s", ret)
+	}
+
+	if _, err := c.Raw(ctx, json.RawMessage(`{"execute": `)); err == nil {
+		t.Error("expected error for invalid JSON")
+	}
+
+	err = c.Execute(ctx, "nope", nil, nil)
+	var qerr *Error
+	if !errors.As(err, &qerr) {
+		t.Fatalf("expected QMP error, got %v", err)
+	}
+	if qerr.Class != "CommandNotFound" {
+		t.Errorf("unexpected error class: %s", qerr.Class)
+	}
+}
+
+func TestClientCancel(t *testing.T) {
+	block := make(chan struct{})
+	c := fakeServer(t, func(cmd string, _ json.RawMessage) (any, *Error) {
+		if cmd == "stop" {
+			<-block
+			return map[string]any{}, nil
+		}
+		return Status{Running: true, Status: "running"}, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := c.Pause(ctx); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// The client is usable after a cancelled command and skips its late response.
+	close(block)
+	s, err := c.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != (Status{Running: true, Status: "running"}) {
+		t.Errorf("unexpected status: %+v", s)
+	}
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	nested "github.com/antonfisher/nested-logrus-formatter"
 	"github.com/cpuguy83/go-docker"
@@ -15,6 +21,7 @@ import (
 	"github.com/cpuguy83/go-docker/container/containerapi/mount"
 	"github.com/cpuguy83/go-docker/transport"
 	"github.com/cpuguy83/qemu-micro-env/build/vmconfig"
+	"github.com/cpuguy83/qemu-micro-env/qmp"
 	"github.com/moby/term"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
@@ -37,13 +44,13 @@ func doRunner(ctx context.Context, cfg config, tr transport.Doer) error {
 	docker := docker.NewClient(docker.WithTransport(tr))
 
 	stateDir := cfg.StateDir
-	if err := os.MkdirAll(stateDir, 0750); err != nil {
+	if err := createState(stateDir); err != nil {
 		return err
 	}
 
 	if !cfg.VM.UseVsock {
 		// add the ssh port forward if we're not using vsock
-		cfg.VM.PortForwards = append([]int{22}, cfg.VM.PortForwards...)
+		cfg.VM.PortForwards = append([]vmconfig.PortForward{{GuestPort: 22, Proto: vmconfig.ProtoTCP}}, cfg.VM.PortForwards...)
 	}
 
 	if !filepath.IsAbs(stateDir) {
@@ -54,7 +61,126 @@ func doRunner(ctx context.Context, cfg config, tr transport.Doer) error {
 		stateDir = filepath.Join(cwd, stateDir)
 	}
 
+	if err := recordImage(stateDir, cfg.ImageRef, cfg.VM.Persist); err != nil {
+		return err
+	}
+
+	if cfg.VM.FromSnapshot != "" {
+		if err := checkLiveSnapshot(stateDir, cfg.VM.FromSnapshot, cfg.ImageRef); err != nil {
+			return err
+		}
+	}
+
+	if err := vmconfig.ValidateNetMode(cfg.VM.Net); err != nil {
+		return err
+	}
+	if err := vmconfig.ValidateNICs(cfg.VM.Net, cfg.VM.NICs); err != nil {
+		return err
+	}
+
+	// The root mode is only known here when the image is built in the same run, the entrypoint checks it otherwise.
+	if cfg.ImageConfig.rootMode == rootModeReadOnly && cfg.VM.Disk == "" {
+		if err := cfg.VM.ValidateReadOnlyRoot(); err != nil {
+			return err
+		}
+	}
+
+	if cfg.VM.GuestUser != "" {
+		if err := vmconfig.ValidateGuestUser(cfg.VM.GuestUser, cfg.VM.Uid, cfg.VM.Gid); err != nil {
+			return err
+		}
+	}
+
+	var cloudImage string
+	if cfg.VM.Disk != "" {
+		_, p, err := vmconfig.ParseDiskSpec(cfg.VM.Disk)
+		if err != nil {
+			return err
+		}
+		cloudImage, err = filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(cloudImage); err != nil {
+			return fmt.Errorf("error checking cloud image: %w", err)
+		}
+		// The entrypoint sees the image where it is mounted in the container.
+		cfg.VM.Disk = vmconfig.CloudImageScheme + "://" + vmconfig.CloudImagePath
+	}
+
+	var dockerdBin string
+	if cfg.VM.DockerdBin != "" {
+		var err error
+		dockerdBin, err = filepath.Abs(cfg.VM.DockerdBin)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(dockerdBin); err != nil {
+			return fmt.Errorf("error checking dockerd binaries: %w", err)
+		}
+		cfg.VM.DockerdBin = vmconfig.DockerdBinPath
+	}
+
+	// The entrypoint sees the mount sources where they are mounted in the container.
+	var sharedMounts []mount.Mount
+	for i, m := range cfg.VM.Mounts {
+		src, err := filepath.Abs(m.Source)
+		if err != nil {
+			return err
+		}
+		fi, err := os.Stat(src)
+		if err != nil {
+			return fmt.Errorf("error checking mount source: %w", err)
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("mount source must be a directory: %s", src)
+		}
+		target := filepath.Join(vmconfig.SharedMountsDir, strconv.Itoa(i))
+		sharedMounts = append(sharedMounts, mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   src,
+			Target:   target,
+			ReadOnly: m.ReadOnly,
+		})
+		cfg.VM.Mounts[i].Source = target
+	}
+
+	var kindConfig string
+	if cfg.VM.Kind != "" {
+		if cfg.VM.Preset != vmconfig.DefaultPreset {
+			return fmt.Errorf("--kind requires the %s preset", vmconfig.DefaultPreset)
+		}
+		if cfg.VM.Disk != "" {
+			return fmt.Errorf("--kind cannot be combined with --disk")
+		}
+		if cfg.VM.Kind != vmconfig.KindDefaultConfig {
+			var err error
+			kindConfig, err = filepath.Abs(string(cfg.VM.Kind))
+			if err != nil {
+				return err
+			}
+			if _, err := os.Stat(kindConfig); err != nil {
+				return fmt.Errorf("error checking kind config: %w", err)
+			}
+			cfg.VM.Kind.Set(vmconfig.KindConfigPath)
+		}
+
+		// The API server gets a fixed host port so the kubeconfig can point at it.
+		kindPort, err := getFreePort()
+		if err != nil {
+			return fmt.Errorf("error getting port for the kind API server: %w", err)
+		}
+		cfg.VM.KindServer = "127.0.0.1:" + strconv.Itoa(kindPort)
+		cfg.VM.PortForwards = append(cfg.VM.PortForwards, vmconfig.PortForward{
+			HostIP:    "127.0.0.1",
+			HostPort:  kindPort,
+			GuestPort: vmconfig.KindAPIServerPort,
+			Proto:     vmconfig.ProtoTCP,
+		})
+	}
+
 	portForwards := cfg.VM.PortForwards
+	netMode := cfg.VM.Net
 	noKVM := cfg.VM.NoKVM
 	useVosck := cfg.VM.UseVsock
 	args := append([]string{entrypointPath}, cfg.VM.AsFlags()...)
@@ -77,14 +203,20 @@ func doRunner(ctx context.Context, cfg config, tr transport.Doer) error {
 
 		cfg.Spec.ExposedPorts = map[string]struct{}{}
 		for _, port := range portForwards {
-			cfg.Spec.ExposedPorts[fmt.Sprintf("%d/tcp", port)] = struct{}{}
+			cfg.Spec.ExposedPorts[port.ContainerPort()] = struct{}{}
 		}
 
-		cfg.Spec.HostConfig.PublishAllPorts = true
+		cfg.Spec.HostConfig.PortBindings = portBindings(portForwards)
 
-		if useVosck {
+		if netMode == vmconfig.NetTap {
+			// The entrypoint creates the bridge and tap device and routes traffic between them and the container network.
+			cfg.Spec.HostConfig.CapAdd = append(cfg.Spec.HostConfig.CapAdd, "NET_ADMIN")
+			cfg.Spec.HostConfig.Sysctls = map[string]string{"net.ipv4.ip_forward": "1"}
+		}
+
+		if useVosck || netMode == vmconfig.NetPasst {
 			// TODO: make custom seccomp profile
-			// Docker's profile rejects AF_VSOCK sockets by default
+			// Docker's profile rejects AF_VSOCK sockets by default, and passt sandboxes itself with unshare(2) which is also rejected.
 			cfg.Spec.HostConfig.SecurityOpt = []string{"seccomp=unconfined"}
 		}
 
@@ -95,6 +227,31 @@ func doRunner(ctx context.Context, cfg config, tr transport.Doer) error {
 			Source: stateDir,
 			Target: "/tmp/sockets",
 		})
+		if cloudImage != "" {
+			cfg.Spec.HostConfig.Mounts = append(cfg.Spec.HostConfig.Mounts, mount.Mount{
+				Type:     mount.TypeBind,
+				Source:   cloudImage,
+				Target:   vmconfig.CloudImagePath,
+				ReadOnly: true,
+			})
+		}
+		cfg.Spec.HostConfig.Mounts = append(cfg.Spec.HostConfig.Mounts, sharedMounts...)
+		if kindConfig != "" {
+			cfg.Spec.HostConfig.Mounts = append(cfg.Spec.HostConfig.Mounts, mount.Mount{
+				Type:     mount.TypeBind,
+				Source:   kindConfig,
+				Target:   vmconfig.KindConfigPath,
+				ReadOnly: true,
+			})
+		}
+		if dockerdBin != "" {
+			cfg.Spec.HostConfig.Mounts = append(cfg.Spec.HostConfig.Mounts, mount.Mount{
+				Type:     mount.TypeBind,
+				Source:   dockerdBin,
+				Target:   vmconfig.DockerdBinPath,
+				ReadOnly: true,
+			})
+		}
 		cfg.Spec.Entrypoint = args
 
 		if _, err := os.Stat("/dev/vhost-net"); err == nil {
@@ -198,6 +355,33 @@ func doRunner(ctx context.Context, cfg config, tr transport.Doer) error {
 	return nil
 }
 
+// getFreePort returns a port that is currently free on the host loopback interface.
+func getFreePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// portBindings returns the docker port bindings for the port forwards.
+// Docker picks a random host port for forwards without a host port.
+func portBindings(forwards []vmconfig.PortForward) containerapi.PortMap {
+	bindings := containerapi.PortMap{}
+	for _, f := range forwards {
+		var hostPort string
+		if f.HostPort != 0 {
+			hostPort = strconv.Itoa(f.HostPort)
+		}
+		bindings[f.ContainerPort()] = append(bindings[f.ContainerPort()], containerapi.PortBinding{
+			HostIP:   f.HostIP,
+			HostPort: hostPort,
+		})
+	}
+	return bindings
+}
+
 func attachPipes(ctx context.Context, c *container.Container, tty bool) error {
 	eg, ctx := errgroup.WithContext(ctx)
 
@@ -241,3 +425,299 @@ func attachPipes(ctx context.Context, c *container.Container, tty bool) error {
 
 	return eg.Wait()
 }
+
+// stateMarkerFile is created in the state dir by run.
+// rm refuses to touch a dir without it so a mistyped state dir is not wiped.
+const stateMarkerFile = ".qemu-micro-env"
+
+// stateFiles are the files and dirs, relative to the state dir, which run creates.
+var stateFiles = []string{
+	stateImageFile,
+	persistedImageFile,
+	vmconfig.PersistedRootDisk,
+	vmconfig.SnapshotsDir,
+	vmconfig.ReadyFile,
+	vmconfig.KindKubeconfig,
+	vmconfig.ControlSocket,
+	vmconfig.QMPSocket,
+	"authorized_keys",
+	"agent.sock",
+	// Socket forwards
+	"s",
+	// kind binary cache
+	"kind",
+}
+
+// createState creates the state dir and marks it as one created by run.
+func createState(stateDir string) error {
+	if err := os.MkdirAll(stateDir, 0750); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(stateDir, stateMarkerFile), nil, 0644)
+}
+
+// removeState removes the files run created in the state dir.
+// Data disks are kept unless removeVolumes is set, in which case the state dir itself is removed too if it is empty.
+func removeState(stateDir string, removeVolumes bool) error {
+	if _, err := os.Stat(stateDir); os.IsNotExist(err) {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, stateMarkerFile)); err != nil {
+		return fmt.Errorf("refusing to remove %s, it is not a state dir created by run: %w", stateDir, err)
+	}
+
+	files := stateFiles
+	if removeVolumes {
+		files = append(files, vmconfig.VolumesDir)
+	}
+	for _, f := range files {
+		if err := os.RemoveAll(filepath.Join(stateDir, f)); err != nil {
+			return err
+		}
+	}
+
+	if !removeVolumes {
+		return nil
+	}
+	if err := os.Remove(filepath.Join(stateDir, stateMarkerFile)); err != nil {
+		return err
+	}
+	if err := os.Remove(stateDir); err != nil {
+		logrus.WithError(err).Warn("State dir has other files in it, not removing it")
+	}
+	return nil
+}
+
+// stateImageFile is the file in the state dir which holds the image ref used for the last run.
+const stateImageFile = "image"
+
+// persistedImageFile is the file in the state dir which holds the image ref the persisted root disk was created with.
+const persistedImageFile = vmconfig.PersistedRootDisk + ".image"
+
+// recordImage stores the image ref in the state dir.
+// A persisted root disk only works with the image it was created from, so persisting with a different image is an error.
+func recordImage(stateDir, ref string, persist bool) error {
+	if persist {
+		p := filepath.Join(stateDir, persistedImageFile)
+		if _, err := os.Stat(filepath.Join(stateDir, vmconfig.PersistedRootDisk)); err == nil {
+			dt, err := os.ReadFile(p)
+			if err == nil && strings.TrimSpace(string(dt)) != ref {
+				return fmt.Errorf("persisted root disk in %s was created from image %s, use that image or remove the disk with the rm command", stateDir, strings.TrimSpace(string(dt)))
+			}
+		}
+		if err := os.WriteFile(p, []byte(ref+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(filepath.Join(stateDir, stateImageFile), []byte(ref+"\n"), 0644)
+}
+
+// doSnapshot manages snapshots of the persisted root disk.
+// This runs the entrypoint of the image the disk was created from, which has the tools needed to manage the disk.
+func doSnapshot(ctx context.Context, cfg config, tr transport.Doer, args []string) error {
+	logrus.SetFormatter(&logFormatter{&nested.Formatter{}, "runner"})
+
+	stateDir, err := filepath.Abs(cfg.StateDir)
+	if err != nil {
+		return err
+	}
+
+	dt, err := os.ReadFile(filepath.Join(stateDir, persistedImageFile))
+	if err != nil {
+		return fmt.Errorf("error reading image for state dir, has the VM been run with --persist?: %w", err)
+	}
+	ref := strings.TrimSpace(string(dt))
+
+	docker := docker.NewClient(docker.WithTransport(tr))
+	c, err := docker.ContainerService().Create(ctx, ref, func(cfg *container.CreateConfig) {
+		cfg.Spec.OpenStdin = true
+		cfg.Spec.AttachStdin = true
+		cfg.Spec.AttachStdout = true
+		cfg.Spec.AttachStderr = true
+		cfg.Spec.HostConfig.AutoRemove = true
+		cfg.Spec.HostConfig.Mounts = append(cfg.Spec.HostConfig.Mounts, mount.Mount{
+			Type:   mount.TypeBind,
+			Source: stateDir,
+			Target: "/tmp/sockets",
+		})
+		cfg.Spec.Entrypoint = append([]string{entrypointPath, "snapshot"}, args...)
+	})
+	if err != nil {
+		return fmt.Errorf("error creating container: %w", err)
+	}
+	defer c.Kill(context.Background())
+
+	ws, err := c.Wait(ctx, container.WithWaitCondition(container.WaitConditionNextExit))
+	if err != nil {
+		return fmt.Errorf("error waiting for container: %w", err)
+	}
+
+	if err := attachPipes(ctx, c, false); err != nil {
+		return err
+	}
+
+	if err := c.Start(ctx); err != nil {
+		return fmt.Errorf("error starting container: %w", err)
+	}
+
+	code, err := ws.ExitCode()
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("snapshot %s failed with exit code %d", strings.Join(args, " "), code)
+	}
+	return nil
+}
+
+// checkLiveSnapshot checks that the live snapshot exists and was taken with the passed in image.
+func checkLiveSnapshot(stateDir, name, ref string) error {
+	if err := vmconfig.ValidateSnapshotName(name); err != nil {
+		return err
+	}
+	dt, err := os.ReadFile(filepath.Join(stateDir, vmconfig.SnapshotsDir, name, vmconfig.SnapshotImageFile))
+	if err != nil {
+		return fmt.Errorf("error reading snapshot %q: %w", name, err)
+	}
+	if saved := strings.TrimSpace(string(dt)); saved != ref {
+		return fmt.Errorf("snapshot %q was taken with image %s, it cannot be restored with image %s", name, saved, ref)
+	}
+	return nil
+}
+
+// doLiveSnapshot saves or lists snapshots of the full state of a running VM.
+// Saving is done by the entrypoint of the running VM, which is reached through the control socket in the state dir.
+func doLiveSnapshot(cfg config, args []string) error {
+	snapshotsDir := filepath.Join(cfg.StateDir, vmconfig.SnapshotsDir)
+
+	switch args[0] {
+	case "list":
+		entries, err := os.ReadDir(snapshotsDir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		for _, e := range entries {
+			if e.IsDir() && !strings.HasSuffix(e.Name(), ".tmp") {
+				fmt.Println(e.Name())
+			}
+		}
+		return nil
+	case "restore":
+		return fmt.Errorf("live snapshots are restored with run --from-snapshot=%s", args[1])
+	}
+
+	name := args[1]
+	if err := vmconfig.ValidateSnapshotName(name); err != nil {
+		return err
+	}
+
+	// The snapshot can only be restored with the image the VM is running.
+	ref, err := os.ReadFile(filepath.Join(cfg.StateDir, stateImageFile))
+	if err != nil {
+		return fmt.Errorf("error reading image of the running VM: %w", err)
+	}
+
+	if _, err := controlRequest(cfg.StateDir, "save "+name+" "+strings.TrimSpace(string(ref))); err != nil {
+		return fmt.Errorf("error saving snapshot: %w", err)
+	}
+	return nil
+}
+
+// controlRequest sends a request to the entrypoint of the running VM over the control socket in the state dir.
+// It returns the output of the request.
+func controlRequest(stateDir, req string) (string, error) {
+	conn, err := net.Dial("unix", filepath.Join(stateDir, vmconfig.ControlSocket))
+	if err != nil {
+		return "", fmt.Errorf("error connecting to the VM, is it running?: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := fmt.Fprintln(conn, req); err != nil {
+		return "", err
+	}
+
+	// The response ends with a status line.
+	var lines []string
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "ok":
+			return strings.Join(lines, "\n"), nil
+		case strings.HasPrefix(line, "error: "):
+			return "", errors.New(strings.TrimPrefix(line, "error: "))
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("error reading response from the VM: %w", err)
+	}
+	return "", fmt.Errorf("error reading response from the VM: %w", io.ErrUnexpectedEOF)
+}
+
+// doPort adds, removes, or lists the ports forwarded to a running VM.
+// Ports added to a running VM cannot be published by docker, they are reachable on the address of the runner container.
+func doPort(stateDir string, args []string) error {
+	var req string
+	switch args[0] {
+	case "add", "rm":
+		if _, err := vmconfig.ParsePortForward(args[1]); err != nil {
+			return err
+		}
+		req = "port-" + args[0] + " " + args[1]
+	case "ls":
+		req = "port-ls"
+	}
+
+	out, err := controlRequest(stateDir, req)
+	if err != nil {
+		return err
+	}
+	if out != "" {
+		fmt.Println(out)
+	}
+	if args[0] == "add" {
+		logrus.Warn("The port is only published on the container address, which is only reachable from the machine docker runs on, e.g. not from the host with Docker Desktop")
+	}
+	return nil
+}
+
+// doVMControl runs a QMP command against the running VM.
+// args is the command followed by the raw JSON request for the qmp command.
+func doVMControl(ctx context.Context, stateDir string, args []string) error {
+	// The VM only has ACPI, which the QMP powerdown command relies on, with cloud images.
+	// The entrypoint knows how to power down either kind of VM.
+	if args[0] == "powerdown" {
+		_, err := controlRequest(stateDir, "powerdown")
+		return err
+	}
+
+	c, err := qmp.Dial(ctx, filepath.Join(stateDir, vmconfig.QMPSocket))
+	if err != nil {
+		return fmt.Errorf("error connecting to the VM, is it running?: %w", err)
+	}
+	defer c.Close()
+
+	switch args[0] {
+	case "status":
+		s, err := c.Status(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Println(s.Status)
+	case "pause":
+		return c.Pause(ctx)
+	case "resume":
+		return c.Resume(ctx)
+	case "qmp":
+		ret, err := c.Raw(ctx, json.RawMessage(args[1]))
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(ret))
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cpuguy83/qemu-micro-env/build/vmconfig"
+)
+
+func TestRemoveState(t *testing.T) {
+	dir := t.TempDir()
+	stateDir := filepath.Join(dir, "state")
+	if err := createState(stateDir); err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(p string) {
+		t.Helper()
+		p = filepath.Join(stateDir, p)
+		if err := os.MkdirAll(filepath.Dir(p), 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exists := func(p string) bool {
+		_, err := os.Stat(filepath.Join(stateDir, p))
+		return err == nil
+	}
+
+	created := []string{
+		stateImageFile,
+		vmconfig.PersistedRootDisk,
+		filepath.Join(vmconfig.SnapshotsDir, "foo", vmconfig.SnapshotImageFile),
+		vmconfig.ReadyFile,
+		filepath.Join("s", "run", "docker.sock"),
+	}
+	for _, p := range created {
+		write(p)
+	}
+	volume := filepath.Join(vmconfig.VolumesDir, "data.qcow2")
+	write(volume)
+	write("notes.txt")
+
+	if err := removeState(stateDir, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range created {
+		if exists(p) {
+			t.Errorf("expected %s to be removed", p)
+		}
+	}
+	for _, p := range []string{volume, "notes.txt", stateMarkerFile} {
+		if !exists(p) {
+			t.Errorf("expected %s to be kept", p)
+		}
+	}
+
+	if err := removeState(stateDir, true); err != nil {
+		t.Fatal(err)
+	}
+	if exists(volume) {
+		t.Error("expected volumes to be removed")
+	}
+	if !exists("notes.txt") {
+		t.Error("expected files not created by run to be kept")
+	}
+
+	// Without the marker nothing is touched.
+	other := filepath.Join(dir, "other")
+	if err := os.MkdirAll(filepath.Join(other, vmconfig.SnapshotsDir), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeState(other, true); err == nil {
+		t.Error("expected error for a dir without the state marker")
+	}
+	if _, err := os.Stat(filepath.Join(other, vmconfig.SnapshotsDir)); err != nil {
+		t.Errorf("expected dir without the state marker to be untouched: %v", err)
+	}
+
+	if err := removeState(filepath.Join(dir, "missing"), true); err != nil {
+		t.Errorf("expected no error for a missing state dir: %v", err)
+	}
+}
+
+func TestControlRequest(t *testing.T) {
+	stateDir := t.TempDir()
+	l, err := net.Listen("unix", filepath.Join(stateDir, vmconfig.ControlSocket))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Responses of the fake entrypoint, keyed by request.
+	responses := map[string]string{
+		"port-ls":    "22/tcp 172.17.0.2:22/tcp\n8080/tcp 172.17.0.2:8080/tcp\nok\n",
+		"port-add 1": "172.17.0.2:1/tcp\nok\n",
+		"port-rm 1":  "ok\n",
+		"port-rm 22": "error: port 22/tcp cannot be removed\n",
+		"truncated":  "172.17.0.2:1/tcp\n",
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			req, _ := bufio.NewReader(conn).ReadString('\n')
+			conn.Write([]byte(responses[req[:len(req)-1]]))
+			conn.Close()
+		}
+	}()
+
+	for _, tc := range []struct {
+		req      string
+		expected string
+		err      string
+	}{
+		{req: "port-ls", expected: "22/tcp 172.17.0.2:22/tcp\n8080/tcp 172.17.0.2:8080/tcp"},
+		{req: "port-add 1", expected: "172.17.0.2:1/tcp"},
+		{req: "port-rm 1"},
+		{req: "port-rm 22", err: "port 22/tcp cannot be removed"},
+		{req: "truncated", err: "error reading response from the VM: unexpected EOF"},
+	} {
+		out, err := controlRequest(stateDir, tc.req)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: expected error %q, got %v", tc.req, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.req, err)
+			continue
+		}
+		if out != tc.expected {
+			t.Errorf("%s: expected output %q, got %q", tc.req, tc.expected, out)
+		}
+	}
+
+	if _, err := controlRequest(t.TempDir(), "port-ls"); err == nil {
+		t.Error("expected error when the VM is not running")
+	}
+}